@@ -0,0 +1,371 @@
+package kcl
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/matijavizintin/go-kcl/checkpointer"
+	"github.com/matijavizintin/go-kcl/locker"
+	"github.com/matijavizintin/go-kcl/shardkey"
+	"github.com/matijavizintin/go-kcl/snitcher"
+)
+
+const maxTimestampReads = 100
+
+var (
+	ErrConsumerGroupActive     = errors.New("Consumer group has locked shards")
+	ErrCheckpointerNotListable = errors.New("Checkpointer can't list checkpoints")
+	ErrLockerNotListable       = errors.New("Locker can't list locks")
+	ErrCheckpointerNotDetailed = errors.New("Checkpointer doesn't keep checkpoint details")
+	ErrSnitcherNotInspectable  = errors.New("Snitcher can't show assignments")
+)
+
+// ResetCheckpointsToTrimHorizon makes the consumer group clientName reprocess every shard of the stream from the oldest
+// record. It returns the new checkpoint of every shard.
+func (c *Client) ResetCheckpointsToTrimHorizon(streamName, clientName string) (map[string]string, error) {
+	return c.resetCheckpoints(streamName, clientName, func(shardId string) (string, error) {
+		return CheckpointTrimHorizon, nil
+	})
+}
+
+// ResetCheckpointsToLatest makes the consumer group clientName skip all records that are in the stream when its readers
+// start.
+func (c *Client) ResetCheckpointsToLatest(streamName, clientName string) (map[string]string, error) {
+	return c.resetCheckpoints(streamName, clientName, func(shardId string) (string, error) {
+		return CheckpointLatest, nil
+	})
+}
+
+// ResetCheckpointsToTimestamp makes the consumer group clientName reprocess the records that arrived at or after ts.
+// The timestamp is resolved to the first such record of every shard. Open shards without one start at ts, closed ones
+// at the latest record.
+func (c *Client) ResetCheckpointsToTimestamp(streamName, clientName string, ts time.Time) (map[string]string, error) {
+	return c.resetCheckpoints(streamName, clientName, func(shardId string) (string, error) {
+		return c.sequenceNumberAt(streamName, shardId, ts)
+	})
+}
+
+// CopyCheckpoints sets the checkpoints of the consumer group toClientName to the positions of fromClientName. Shards
+// fromClientName has no checkpoint for start at the oldest record.
+func (c *Client) CopyCheckpoints(streamName, fromClientName, toClientName string) (map[string]string, error) {
+	return c.resetCheckpoints(streamName, toClientName, func(shardId string) (string, error) {
+		checkpoint, err := c.checkpoint.GetCheckpoint(c.shardKey(streamName, shardId, fromClientName))
+		if err != nil {
+			return "", err
+		}
+
+		if checkpoint == "" {
+			return CheckpointTrimHorizon, nil
+		}
+		return checkpoint, nil
+	})
+}
+
+// resetCheckpoints resolves the new checkpoint of every shard first and writes them only when all were resolved so a
+// failure doesn't leave the group half reset. It refuses to run while any shard of the group is locked since the
+// running reader would overwrite the checkpoint.
+func (c *Client) resetCheckpoints(streamName, clientName string, position func(shardId string) (string, error)) (map[string]string, error) {
+	if c.checkpoint == nil {
+		return nil, ErrMissingCheckpointer
+	}
+	if c.distlock == nil {
+		return nil, ErrMissingLocker
+	}
+
+	shards, err := c.ListShards(streamName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, shard := range shards {
+		locked, err := c.distlock.IsLocked(c.shardKey(streamName, aws.StringValue(shard.ShardId), clientName))
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return nil, ErrConsumerGroupActive
+		}
+	}
+
+	checkpoints := map[string]string{}
+	for _, shard := range shards {
+		shardId := aws.StringValue(shard.ShardId)
+
+		checkpoint, err := position(shardId)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints[shardId] = checkpoint
+	}
+
+	for shardId, checkpoint := range checkpoints {
+		err := c.checkpoint.ForceCheckpoint(c.shardKey(streamName, shardId, clientName), checkpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return checkpoints, nil
+}
+
+// sequenceNumberAt returns a checkpoint that resumes at the first record of the shard that arrived at or after ts.
+// GetRecords may return empty pages before the first record so pages are followed until a record or the tip of the
+// shard is reached.
+func (c *Client) sequenceNumberAt(streamName, shardId string, ts time.Time) (string, error) {
+	iterator, err := c.kinesis.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(streamName),
+		ShardId:           aws.String(shardId),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeAtTimestamp),
+		Timestamp:         aws.Time(ts),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	shardIterator := iterator.ShardIterator
+	for i := 0; i < maxTimestampReads && shardIterator != nil; i++ {
+		out, err := c.kinesis.GetRecords(&kinesis.GetRecordsInput{
+			Limit:         aws.Int64(1),
+			ShardIterator: shardIterator,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		if len(out.Records) > 0 {
+			return checkpointAtPrefix + aws.StringValue(out.Records[0].SequenceNumber), nil
+		}
+		shardIterator = out.NextShardIterator
+		if aws.Int64Value(out.MillisBehindLatest) == 0 {
+			break
+		}
+	}
+
+	// a closed shard without records after ts has nothing left to read, LATEST reads nothing from it as well
+	if shardIterator == nil {
+		return CheckpointLatest, nil
+	}
+	// records may still arrive on an open shard, LATEST would skip those that arrive before the reader starts
+	return checkpointTimestampPrefix + ts.UTC().Format(time.RFC3339Nano), nil
+}
+
+// ConsumerGroups returns the client names that have checkpoints on the stream.
+func (c *Client) ConsumerGroups(streamName string) ([]string, error) {
+	checkpoints, err := c.listCheckpoints(c.shardKey(streamName, "", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for key := range checkpoints {
+		found[key.ClientName] = true
+	}
+
+	groups := []string{}
+	for group := range found {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
+
+// DeleteConsumerGroup deletes all checkpoints of clientName on the stream. It's refused while any shard of the group
+// is locked.
+func (c *Client) DeleteConsumerGroup(streamName, clientName string) error {
+	listable, err := c.listableCheckpointer()
+	if err != nil {
+		return err
+	}
+
+	checkpoints, err := listable.ListCheckpoints(c.shardKey(streamName, "", clientName))
+	if err != nil {
+		return err
+	}
+
+	keys := []shardkey.ShardKey{}
+	for key := range checkpoints {
+		keys = append(keys, key)
+	}
+
+	if c.distlock == nil {
+		return ErrMissingLocker
+	}
+	for _, key := range keys {
+		locked, err := c.distlock.IsLocked(key)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return ErrConsumerGroupActive
+		}
+	}
+
+	for _, key := range keys {
+		err := listable.DeleteCheckpoint(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckpointDetails returns the current checkpoint of the consumer group clientName on the shard with its metadata, or
+// nil if there is none. It requires a DetailedCheckpointer.
+func (c *Client) CheckpointDetails(streamName, shardId, clientName string) (*checkpointer.Checkpoint, error) {
+	detailed, err := c.detailedCheckpointer()
+	if err != nil {
+		return nil, err
+	}
+
+	return detailed.GetCheckpointDetails(c.shardKey(streamName, shardId, clientName))
+}
+
+// CheckpointHistory returns the last checkpoints of the consumer group clientName on the shard, the newest first, to
+// audit who moved the checkpoint and when. It requires a DetailedCheckpointer.
+func (c *Client) CheckpointHistory(streamName, shardId, clientName string) ([]*checkpointer.Checkpoint, error) {
+	detailed, err := c.detailedCheckpointer()
+	if err != nil {
+		return nil, err
+	}
+
+	return detailed.CheckpointHistory(c.shardKey(streamName, shardId, clientName))
+}
+
+// ShardAssignments returns the owners of the shards of the consumer group clientName on the stream as stored by all
+// snitchers of the group. An empty clientName returns the owners of all groups. It requires a snitcher.Inspector.
+func (c *Client) ShardAssignments(streamName, clientName string) ([]*snitcher.Assignment, error) {
+	inspector, err := c.snitchInspector()
+	if err != nil {
+		return nil, err
+	}
+
+	assignments, err := inspector.ClusterAssignments()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := c.shardKey(streamName, "", clientName)
+	matching := []*snitcher.Assignment{}
+	for _, assignment := range assignments {
+		if assignment.Key.Matches(filter) {
+			matching = append(matching, assignment)
+		}
+	}
+	return matching, nil
+}
+
+// LocalShardAssignments returns the owners of the shards registered with the client's snitcher, i.e. the shards its
+// readers compete for. It requires a snitcher.Inspector.
+func (c *Client) LocalShardAssignments() ([]*snitcher.Assignment, error) {
+	inspector, err := c.snitchInspector()
+	if err != nil {
+		return nil, err
+	}
+
+	return inspector.Assignments()
+}
+
+// DeleteStreamWithParameters deletes the stream and with purgeState also the checkpoints and locks of all consumer
+// groups on it, which requires a ListableCheckpointer and a ListableLocker.
+func (c *Client) DeleteStreamWithParameters(streamName string, purgeState bool) error {
+	if !purgeState {
+		return c.DeleteStream(streamName)
+	}
+
+	listableCheckpointer, ok := c.checkpoint.(checkpointer.ListableCheckpointer)
+	if !ok {
+		return ErrCheckpointerNotListable
+	}
+	listableLocker, ok := c.distlock.(locker.ListableLocker)
+	if !ok {
+		return ErrLockerNotListable
+	}
+
+	err := c.DeleteStream(streamName)
+	if err != nil && !isResourceNotFound(err) {
+		return err
+	}
+
+	filter := c.shardKey(streamName, "", "")
+	checkpoints, err := listableCheckpointer.ListCheckpoints(filter)
+	if err != nil {
+		return err
+	}
+	locks, err := listableLocker.ListLocks(filter)
+	if err != nil {
+		return err
+	}
+
+	// lock names are the checkpoint keys, deleting them also removes the fencing counters of released locks
+	keys := map[shardkey.ShardKey]bool{}
+	for key := range checkpoints {
+		err = listableCheckpointer.DeleteCheckpoint(key)
+		if err != nil {
+			return err
+		}
+		keys[key] = true
+	}
+	for _, key := range locks {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		err = listableLocker.DeleteLock(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	Logger.Printf("Stream %s deleted, purged %d checkpoints and %d locks", streamName, len(checkpoints), len(locks))
+	return nil
+}
+
+func (c *Client) listCheckpoints(filter shardkey.ShardKey) (map[shardkey.ShardKey]string, error) {
+	listable, err := c.listableCheckpointer()
+	if err != nil {
+		return nil, err
+	}
+
+	return listable.ListCheckpoints(filter)
+}
+
+func (c *Client) listableCheckpointer() (checkpointer.ListableCheckpointer, error) {
+	if c.checkpoint == nil {
+		return nil, ErrMissingCheckpointer
+	}
+
+	listable, ok := c.checkpoint.(checkpointer.ListableCheckpointer)
+	if !ok {
+		return nil, ErrCheckpointerNotListable
+	}
+	return listable, nil
+}
+
+func (c *Client) snitchInspector() (snitcher.Inspector, error) {
+	if c.snitch == nil {
+		return nil, ErrMissingSnitcher
+	}
+
+	inspector, ok := c.snitch.(snitcher.Inspector)
+	if !ok {
+		return nil, ErrSnitcherNotInspectable
+	}
+	return inspector, nil
+}
+
+func (c *Client) detailedCheckpointer() (checkpointer.DetailedCheckpointer, error) {
+	if c.checkpoint == nil {
+		return nil, ErrMissingCheckpointer
+	}
+
+	detailed, ok := c.checkpoint.(checkpointer.DetailedCheckpointer)
+	if !ok {
+		return nil, ErrCheckpointerNotDetailed
+	}
+	return detailed, nil
+}
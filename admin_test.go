@@ -0,0 +1,115 @@
+package kcl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+	"github.com/matijavizintin/go-kcl/snitcher"
+)
+
+func TestResetCheckpointsToTimestampOnEmptyOpenShard(t *testing.T) {
+	fk := newFakeKinesis()
+	open := fk.addShard("shard-0")
+	closed := fk.addShard("shard-1")
+
+	ts := time.Now()
+	fk.putRecords(open, 1000, 10, ts.Add(-time.Hour))
+	fk.putRecords(closed, 2000, 10, ts.Add(-time.Hour))
+	fk.closeShard(closed)
+
+	client := newTestClient(fk)
+	checkpoints, err := client.ResetCheckpointsToTimestamp("stream", "client", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoints["shard-1"] != CheckpointLatest {
+		t.Errorf("Closed shard checkpoint is %s, expected %s", checkpoints["shard-1"], CheckpointLatest)
+	}
+
+	// records that arrive on the open shard after the reset and before the reader starts must be read
+	fk.putRecords(open, 1000, 5, ts.Add(time.Second))
+
+	reader, err := client.NewReaderWithParameters("stream", "shard-0", "client", time.Millisecond, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := reader.Records()
+
+	select {
+	case record, ok := <-records:
+		if !ok {
+			t.Fatalf("Records channel closed: %v", reader.Close())
+		}
+		if *record.SequenceNumber != "1010" {
+			t.Errorf("First record is %s, expected 1010", *record.SequenceNumber)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No record was read after the reset")
+	}
+	reader.Close()
+}
+
+func TestDeleteConsumerGroupRequiresListableCheckpointer(t *testing.T) {
+	client := newTestClient(newFakeKinesis())
+
+	err := client.DeleteConsumerGroup("stream", "client")
+	if err != ErrCheckpointerNotListable {
+		t.Errorf("Got %v, expected %v", err, ErrCheckpointerNotListable)
+	}
+}
+
+func TestShardAssignmentsOfConsumerGroup(t *testing.T) {
+	client := newTestClient(newFakeKinesis())
+
+	_, err := client.ShardAssignments("stream", "client")
+	if err != ErrSnitcherNotInspectable {
+		t.Errorf("Got %v, expected %v", err, ErrSnitcherNotInspectable)
+	}
+
+	bs := snitcher.NewBalancingSnitcherWithParameters(snitcher.NewMemoryStore(time.Second), snitcher.NewEvenStrategy(), 10*time.Millisecond)
+	defer bs.Close()
+	client.snitch = bs
+
+	keys := []shardkey.ShardKey{
+		client.shardKey("stream", "shard-0", "client"),
+		client.shardKey("stream", "shard-1", "client"),
+		client.shardKey("stream", "shard-0", "other"),
+		client.shardKey("other", "shard-0", "client"),
+	}
+	for _, key := range keys {
+		bs.RegisterKey(key)
+	}
+	waitFor(t, func() bool {
+		for _, key := range keys {
+			if !bs.CheckOwnership(key) {
+				return false
+			}
+		}
+		return true
+	})
+
+	assignments, err := client.ShardAssignments("stream", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assignments) != 2 || assignments[0].Key != keys[0] || assignments[1].Key != keys[1] {
+		t.Errorf("Got assignments %v, expected the shards of the group on the stream", assignments)
+	}
+
+	assignments, err = client.ShardAssignments("stream", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assignments) != 3 {
+		t.Errorf("Got %d assignments of all groups on the stream, expected 3", len(assignments))
+	}
+
+	local, err := client.LocalShardAssignments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local) != len(keys) {
+		t.Errorf("Got %d local assignments, expected %d", len(local), len(keys))
+	}
+}
@@ -0,0 +1,374 @@
+package kcl
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	ScaleUp   = "SCALE_UP"
+	ScaleDown = "SCALE_DOWN"
+	ScaleHold = "HOLD"
+
+	// UpdateShardCount may be called at most 10 times per stream in a rolling 24 hour window
+	maxShardCountUpdates = 10
+	updateLimitWindow    = 24 * time.Hour
+)
+
+var ErrInvalidScalingRules = errors.New("Invalid scaling rules")
+
+// Throughput is the write rate of a whole stream, per second.
+type Throughput struct {
+	IncomingBytes   float64
+	IncomingRecords float64
+	// WriteThrottled is the rate of records rejected with ProvisionedThroughputExceeded
+	WriteThrottled float64
+}
+
+// ThroughputSource provides the write rate of a stream, e.g. from CloudWatch metrics or a TrafficSampler.
+type ThroughputSource interface {
+	Throughput(streamName string) (*Throughput, error)
+}
+
+type ScalingRules struct {
+	// TargetUtilisation is the share of the stream's write capacity that should be in use after scaling.
+	TargetUtilisation float64
+	// the stream is scaled up above ScaleUpUtilisation and down below ScaleDownUtilisation
+	ScaleUpUtilisation   float64
+	ScaleDownUtilisation float64
+	// ThrottleThreshold is the rate of throttled records above which the stream is scaled up regardless of utilisation
+	ThrottleThreshold float64
+
+	MinShards int
+	MaxShards int
+
+	// cooldowns are measured from the last change of the shard count in any direction
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+
+	// MaxUpdatesPerDay caps the UpdateShardCount calls in a rolling day, it can't exceed the Kinesis limit of 10.
+	MaxUpdatesPerDay int
+}
+
+var DefaultScalingRules = ScalingRules{
+	TargetUtilisation:    0.6,
+	ScaleUpUtilisation:   0.8,
+	ScaleDownUtilisation: 0.25,
+	ThrottleThreshold:    0,
+	MinShards:            1,
+	MaxShards:            500,
+	ScaleUpCooldown:      5 * time.Minute,
+	ScaleDownCooldown:    time.Hour,
+	MaxUpdatesPerDay:     maxShardCountUpdates,
+}
+
+// ScalingEvent is a decision of the autoscaler. Decisions to keep the shard count are recorded as well so the log
+// explains why a stream was not scaled.
+type ScalingEvent struct {
+	Time          time.Time `json:"time"`
+	StreamName    string    `json:"streamName"`
+	Action        string    `json:"action"`
+	CurrentShards int       `json:"currentShards"`
+	TargetShards  int       `json:"targetShards"`
+	Utilisation   float64   `json:"utilisation"`
+	Throttled     float64   `json:"throttled"`
+	Reason        string    `json:"reason"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type EventLog interface {
+	Record(event *ScalingEvent) error
+}
+
+// MemoryEventLog keeps the last events in memory.
+type MemoryEventLog struct {
+	size   int
+	events []*ScalingEvent
+	mu     sync.Mutex
+}
+
+func NewMemoryEventLog(size int) *MemoryEventLog {
+	return &MemoryEventLog{
+		size: size,
+	}
+}
+
+func (ml *MemoryEventLog) Record(event *ScalingEvent) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	ml.events = append(ml.events, event)
+	if len(ml.events) > ml.size {
+		ml.events = ml.events[len(ml.events)-ml.size:]
+	}
+	return nil
+}
+
+// Events returns the recorded events, oldest first.
+func (ml *MemoryEventLog) Events() []*ScalingEvent {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	return append([]*ScalingEvent{}, ml.events...)
+}
+
+// JSONEventLog writes every event as a line of json, e.g. to an append-only file.
+type JSONEventLog struct {
+	encoder *json.Encoder
+	mu      sync.Mutex
+}
+
+func NewJSONEventLog(w io.Writer) *JSONEventLog {
+	return &JSONEventLog{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (jl *JSONEventLog) Record(event *ScalingEvent) error {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+
+	return jl.encoder.Encode(event)
+}
+
+// ReadJSONEventLog reads the events written by a JSONEventLog.
+func ReadJSONEventLog(r io.Reader) ([]*ScalingEvent, error) {
+	events := []*ScalingEvent{}
+
+	decoder := json.NewDecoder(r)
+	for {
+		event := &ScalingEvent{}
+		err := decoder.Decode(event)
+		if err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
+
+// Autoscaler adjusts the shard count of streams to their write throughput with UpdateShardCount, respecting its limits
+// of at most doubling or halving the shard count per call and a number of calls per day.
+type Autoscaler struct {
+	client *Client
+	source ThroughputSource
+	rules  ScalingRules
+	log    EventLog
+	now    func() time.Time
+
+	updates    map[string][]time.Time
+	lastChange map[string]time.Time
+	mu         sync.Mutex
+
+	stop chan struct{}
+}
+
+// NewAutoscaler creates an autoscaler that reads throughput from source and records decisions to log. Nil rules mean
+// DefaultScalingRules. It returns ErrInvalidScalingRules when the target utilisation isn't positive or the shard
+// limits are inconsistent.
+//
+// Cooldowns and the daily update count are kept in memory. After a restart they are restored from the recorded
+// events with Restore, and since replicas don't share them a stream should be scaled by a single autoscaler, e.g. one
+// that holds a lock.
+func (c *Client) NewAutoscaler(source ThroughputSource, rules *ScalingRules, log EventLog) (*Autoscaler, error) {
+	if rules == nil {
+		rules = &DefaultScalingRules
+	}
+	if rules.TargetUtilisation <= 0 || rules.MinShards < 1 || rules.MaxShards < rules.MinShards {
+		return nil, ErrInvalidScalingRules
+	}
+
+	return &Autoscaler{
+		client:     c,
+		source:     source,
+		rules:      *rules,
+		log:        log,
+		now:        time.Now,
+		updates:    map[string][]time.Time{},
+		lastChange: map[string]time.Time{},
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+// Run evaluates the streams every interval until Stop is called.
+func (a *Autoscaler) Run(interval time.Duration, streamNames ...string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			return
+		}
+
+		for _, streamName := range streamNames {
+			_, err := a.Evaluate(streamName)
+			if err != nil {
+				Logger.Printf("Autoscaling %s failed. Err: %v", streamName, err)
+			}
+		}
+	}
+}
+
+func (a *Autoscaler) Stop() {
+	close(a.stop)
+}
+
+// Restore replays events recorded by an earlier autoscaler, e.g. read with ReadJSONEventLog, so the cooldowns and the
+// daily update limit carry over a restart. Events have to be in the order they were recorded.
+func (a *Autoscaler) Restore(events []*ScalingEvent) {
+	for _, event := range events {
+		if event.Action == ScaleHold || event.Error != "" {
+			continue
+		}
+		a.recordUpdate(event.StreamName, event.Time)
+	}
+}
+
+// Evaluate decides on the shard count of the stream, applies it and records the decision.
+func (a *Autoscaler) Evaluate(streamName string) (*ScalingEvent, error) {
+	summary, err := a.client.streamSummary(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	throughput, err := a.source.Throughput(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	event := a.decide(streamName, int(aws.Int64Value(summary.OpenShardCount)), throughput)
+	if event.Action != ScaleHold {
+		err = a.client.UpdateStream(streamName, event.TargetShards)
+		if err != nil {
+			event.Error = err.Error()
+		} else {
+			a.recordUpdate(streamName, event.Time)
+		}
+	}
+
+	if a.log != nil {
+		logErr := a.log.Record(event)
+		if logErr != nil {
+			Logger.Printf("Recording scaling event failed. Err: %v", logErr)
+		}
+	}
+
+	return event, err
+}
+
+func (a *Autoscaler) decide(streamName string, shards int, throughput *Throughput) *ScalingEvent {
+	now := a.now()
+	event := &ScalingEvent{
+		Time:          now,
+		StreamName:    streamName,
+		Action:        ScaleHold,
+		CurrentShards: shards,
+		TargetShards:  shards,
+		Throttled:     throughput.WriteThrottled,
+	}
+	if shards == 0 {
+		event.Reason = "stream has no open shards"
+		return event
+	}
+
+	utilisation := math.Max(
+		throughput.IncomingBytes/float64(shards*shardBytesLimit),
+		throughput.IncomingRecords/float64(shards*shardRecordsLimit),
+	)
+	event.Utilisation = utilisation
+
+	desired := int(math.Ceil(float64(shards) * utilisation / a.rules.TargetUtilisation))
+	switch {
+	case throughput.WriteThrottled > a.rules.ThrottleThreshold:
+		event.Action = ScaleUp
+		event.Reason = "writes are throttled"
+		if desired <= shards {
+			desired = shards + 1
+		}
+	case utilisation > a.rules.ScaleUpUtilisation:
+		event.Action = ScaleUp
+		event.Reason = "utilisation above scale up threshold"
+	case utilisation < a.rules.ScaleDownUtilisation:
+		event.Action = ScaleDown
+		event.Reason = "utilisation below scale down threshold"
+	default:
+		event.Reason = "utilisation within thresholds"
+		return event
+	}
+
+	// UpdateShardCount can at most double or halve the shard count
+	desired = clamp(desired, (shards+1)/2, shards*2)
+	desired = clamp(desired, a.rules.MinShards, a.rules.MaxShards)
+	if desired == shards || (event.Action == ScaleUp) != (desired > shards) {
+		event.Action = ScaleHold
+		event.Reason += ", shard count limit reached"
+		return event
+	}
+
+	a.mu.Lock()
+	lastChange, changed := a.lastChange[streamName]
+	updates := a.recentUpdates(streamName, now)
+	a.mu.Unlock()
+
+	cooldown := a.rules.ScaleUpCooldown
+	if event.Action == ScaleDown {
+		cooldown = a.rules.ScaleDownCooldown
+	}
+	if changed && now.Sub(lastChange) < cooldown {
+		event.Action = ScaleHold
+		event.Reason += ", cooling down"
+		return event
+	}
+
+	maxUpdates := a.rules.MaxUpdatesPerDay
+	if maxUpdates <= 0 || maxUpdates > maxShardCountUpdates {
+		maxUpdates = maxShardCountUpdates
+	}
+	if updates >= maxUpdates {
+		event.Action = ScaleHold
+		event.Reason += ", daily update limit reached"
+		return event
+	}
+
+	event.TargetShards = desired
+	return event
+}
+
+func (a *Autoscaler) recordUpdate(streamName string, ts time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.updates[streamName] = append(a.updates[streamName], ts)
+	a.lastChange[streamName] = ts
+}
+
+// recentUpdates drops updates older than the limit window and returns the number of remaining ones. It must be called
+// with mu held.
+func (a *Autoscaler) recentUpdates(streamName string, now time.Time) int {
+	updates := a.updates[streamName]
+	for len(updates) > 0 && now.Sub(updates[0]) >= updateLimitWindow {
+		updates = updates[1:]
+	}
+	a.updates[streamName] = updates
+
+	return len(updates)
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
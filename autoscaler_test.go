@@ -0,0 +1,234 @@
+package kcl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// scalingKinesis keeps the shard count of a stream and applies UpdateShardCount right away.
+type scalingKinesis struct {
+	kinesisiface.KinesisAPI
+
+	shards  int
+	updates int
+}
+
+func (sk *scalingKinesis) DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamName:     input.StreamName,
+			StreamStatus:   aws.String(kinesis.StreamStatusActive),
+			OpenShardCount: aws.Int64(int64(sk.shards)),
+		},
+	}, nil
+}
+
+func (sk *scalingKinesis) UpdateShardCount(input *kinesis.UpdateShardCountInput) (*kinesis.UpdateShardCountOutput, error) {
+	sk.shards = int(aws.Int64Value(input.TargetShardCount))
+	sk.updates++
+	return &kinesis.UpdateShardCountOutput{}, nil
+}
+
+// fixedThroughput reports the same throughput for every stream.
+type fixedThroughput struct {
+	throughput Throughput
+}
+
+func (ft *fixedThroughput) Throughput(streamName string) (*Throughput, error) {
+	throughput := ft.throughput
+	return &throughput, nil
+}
+
+// utilised returns the throughput that uses the share utilisation of the write capacity of shards.
+func utilised(shards int, utilisation float64) Throughput {
+	return Throughput{IncomingBytes: float64(shards*shardBytesLimit) * utilisation}
+}
+
+type testAutoscaler struct {
+	*Autoscaler
+
+	kinesis *scalingKinesis
+	source  *fixedThroughput
+	clock   time.Time
+}
+
+func newTestAutoscaler(t *testing.T, shards int, rules *ScalingRules) *testAutoscaler {
+	sk := &scalingKinesis{shards: shards}
+	source := &fixedThroughput{}
+
+	autoscaler, err := (&Client{kinesis: sk}).NewAutoscaler(source, rules, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta := &testAutoscaler{
+		Autoscaler: autoscaler,
+		kinesis:    sk,
+		source:     source,
+		clock:      time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	autoscaler.now = func() time.Time {
+		return ta.clock
+	}
+	return ta
+}
+
+func (ta *testAutoscaler) evaluate(t *testing.T, utilisation float64) *ScalingEvent {
+	ta.source.throughput = utilised(ta.kinesis.shards, utilisation)
+
+	event, err := ta.Evaluate("stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func expectEvent(t *testing.T, event *ScalingEvent, action string, targetShards int, reason string) {
+	if event.Action != action || event.TargetShards != targetShards {
+		t.Errorf("Got %s to %d shards (%s), expected %s to %d", event.Action, event.TargetShards, event.Reason, action,
+			targetShards)
+	}
+	if !strings.Contains(event.Reason, reason) {
+		t.Errorf("Got reason %q, expected %q", event.Reason, reason)
+	}
+}
+
+func TestAutoscalerScalesUp(t *testing.T) {
+	ta := newTestAutoscaler(t, 2, nil)
+
+	// 0.85 of 2 shards needs 3 shards at the target of 0.6
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 3, "above scale up threshold")
+	if ta.kinesis.shards != 3 {
+		t.Errorf("Stream has %d shards, expected 3", ta.kinesis.shards)
+	}
+
+	// UpdateShardCount can at most double the shard count
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleUpCooldown)
+	expectEvent(t, ta.evaluate(t, 0.95), ScaleUp, 5, "above scale up threshold")
+
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleUpCooldown)
+	ta.source.throughput.WriteThrottled = 1
+	event, err := ta.Evaluate("stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, event, ScaleUp, 6, "throttled")
+}
+
+func TestAutoscalerScalesDown(t *testing.T) {
+	ta := newTestAutoscaler(t, 4, nil)
+
+	// UpdateShardCount can at most halve the shard count
+	expectEvent(t, ta.evaluate(t, 0.1), ScaleDown, 2, "below scale down threshold")
+
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleDownCooldown)
+	expectEvent(t, ta.evaluate(t, 0.1), ScaleDown, 1, "below scale down threshold")
+
+	// the minimum shard count is reached
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleDownCooldown)
+	expectEvent(t, ta.evaluate(t, 0.1), ScaleHold, 1, "shard count limit reached")
+
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleDownCooldown)
+	expectEvent(t, ta.evaluate(t, 0.5), ScaleHold, 1, "within thresholds")
+	if ta.kinesis.updates != 2 {
+		t.Errorf("Shard count updated %d times, expected 2", ta.kinesis.updates)
+	}
+}
+
+func TestAutoscalerCooldown(t *testing.T) {
+	ta := newTestAutoscaler(t, 2, nil)
+
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 3, "")
+
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleUpCooldown - time.Second)
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleHold, 3, "cooling down")
+
+	ta.clock = ta.clock.Add(time.Second)
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 5, "")
+
+	// the longer scale down cooldown is measured from the last scale up too
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleUpCooldown)
+	expectEvent(t, ta.evaluate(t, 0.1), ScaleHold, 5, "cooling down")
+
+	ta.clock = ta.clock.Add(DefaultScalingRules.ScaleDownCooldown)
+	expectEvent(t, ta.evaluate(t, 0.1), ScaleDown, 3, "")
+}
+
+func TestAutoscalerDailyUpdateLimit(t *testing.T) {
+	rules := DefaultScalingRules
+	rules.ScaleUpCooldown = 0
+	rules.MaxUpdatesPerDay = 2
+	ta := newTestAutoscaler(t, 2, &rules)
+
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 3, "")
+	ta.clock = ta.clock.Add(time.Hour)
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 5, "")
+	ta.clock = ta.clock.Add(time.Hour)
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleHold, 5, "daily update limit reached")
+
+	// the first update leaves the rolling window
+	ta.clock = ta.clock.Add(22 * time.Hour)
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 8, "")
+	if ta.kinesis.updates != 3 {
+		t.Errorf("Shard count updated %d times, expected 3", ta.kinesis.updates)
+	}
+}
+
+func TestAutoscalerRejectsInvalidRules(t *testing.T) {
+	invalid := map[string]func(rules *ScalingRules){
+		"zero target":          func(rules *ScalingRules) { rules.TargetUtilisation = 0 },
+		"negative target":      func(rules *ScalingRules) { rules.TargetUtilisation = -0.5 },
+		"no min shards":        func(rules *ScalingRules) { rules.MinShards = 0 },
+		"max below min shards": func(rules *ScalingRules) { rules.MinShards, rules.MaxShards = 10, 5 },
+		"negative max shards":  func(rules *ScalingRules) { rules.MaxShards = -1 },
+	}
+
+	client := &Client{kinesis: &scalingKinesis{}}
+	for name, change := range invalid {
+		rules := DefaultScalingRules
+		change(&rules)
+
+		_, err := client.NewAutoscaler(&fixedThroughput{}, &rules, nil)
+		if err != ErrInvalidScalingRules {
+			t.Errorf("%s: got %v, expected %v", name, err, ErrInvalidScalingRules)
+		}
+	}
+}
+
+func TestAutoscalerRestoresRecordedUpdates(t *testing.T) {
+	rules := DefaultScalingRules
+	rules.MaxUpdatesPerDay = 2
+
+	buf := &bytes.Buffer{}
+	ta := newTestAutoscaler(t, 2, &rules)
+	ta.log = NewJSONEventLog(buf)
+
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 3, "")
+	ta.clock = ta.clock.Add(time.Hour)
+	expectEvent(t, ta.evaluate(t, 0.85), ScaleUp, 5, "")
+	ta.clock = ta.clock.Add(time.Minute)
+	expectEvent(t, ta.evaluate(t, 0.1), ScaleHold, 5, "cooling down")
+
+	events, err := ReadJSONEventLog(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Read %d events, expected 3", len(events))
+	}
+
+	// a restarted autoscaler keeps cooling down and respects the updates of the one before it
+	restarted := newTestAutoscaler(t, 5, &rules)
+	restarted.clock = ta.clock
+	restarted.Restore(events)
+
+	expectEvent(t, restarted.evaluate(t, 0.1), ScaleHold, 5, "cooling down")
+	restarted.clock = restarted.clock.Add(DefaultScalingRules.ScaleDownCooldown)
+	expectEvent(t, restarted.evaluate(t, 0.1), ScaleHold, 5, "daily update limit reached")
+}
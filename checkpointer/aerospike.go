@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/aerospike/aerospike-client-go"
+	"github.com/matijavizintin/go-kcl/shardkey"
 )
 
 const (
@@ -12,6 +13,8 @@ const (
 	aerospikeTTL = 365 * 24 * 3600
 	waitRetries  = 3
 	setName      = "kcl_checkpoint"
+
+	defaultHistorySize = 10
 )
 
 type AerospikeReleaser struct {
@@ -20,40 +23,150 @@ type AerospikeReleaser struct {
 }
 
 type AerospikeCheckpointer struct {
-	client    *aerospike.Client
-	namespace string
+	client      *aerospike.Client
+	namespace   string
+	historySize int
 }
 
 func NewAerospikeCheckpointer(client *aerospike.Client, namespace string) *AerospikeCheckpointer {
+	return NewAerospikeCheckpointerWithParameters(client, namespace, defaultHistorySize)
+}
+
+// NewAerospikeCheckpointerWithParameters initializes a checkpointer that keeps the last historySize checkpoints of
+// every key.
+func NewAerospikeCheckpointerWithParameters(client *aerospike.Client, namespace string, historySize int) *AerospikeCheckpointer {
 	return &AerospikeCheckpointer{
-		client:    client,
-		namespace: namespace,
+		client:      client,
+		namespace:   namespace,
+		historySize: historySize,
+	}
+}
+
+// GetCheckpoint returns the checkpoint of the key. Keys without a namespace fall back to the checkpoint stored under
+// the legacy key until a checkpoint is set, so readers resume where they were before keys were structured.
+func (al *AerospikeCheckpointer) GetCheckpoint(key shardkey.ShardKey) (string, error) {
+	checkpoint, err := al.GetCheckpointDetails(key)
+	if err != nil || checkpoint == nil {
+		return "", err
+	}
+	return checkpoint.SequenceNumber, nil
+}
+
+func (al *AerospikeCheckpointer) GetCheckpointDetails(key shardkey.ShardKey) (*Checkpoint, error) {
+	record, err := al.getWithRetries(key)
+	if err != nil {
+		return nil, err
 	}
+	return decodeCheckpoint(record), nil
+}
+
+// CheckpointHistory returns the last checkpoints of the key. Checkpoints written before the history was kept have
+// only the current checkpoint.
+func (al *AerospikeCheckpointer) CheckpointHistory(key shardkey.ShardKey) ([]*Checkpoint, error) {
+	record, err := al.getWithRetries(key)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []*Checkpoint{}
+	for _, entry := range recordHistory(record) {
+		history = append(history, decodeEntry(entry))
+	}
+	return history, nil
+}
+
+func (al *AerospikeCheckpointer) SetCheckpoint(key shardkey.ShardKey, value string) error {
+	return al.setWithRetries(key, &Checkpoint{SequenceNumber: value}, false)
+}
+
+func (al *AerospikeCheckpointer) ForceCheckpoint(key shardkey.ShardKey, value string) error {
+	return al.setWithRetries(key, &Checkpoint{SequenceNumber: value}, true)
+}
+
+// SetCheckpointFenced sets the checkpoint unless it was written with a greater token. The check and the write are
+// done atomically with a generation check.
+func (al *AerospikeCheckpointer) SetCheckpointFenced(key shardkey.ShardKey, value string, token int64) error {
+	return al.setWithRetries(key, &Checkpoint{SequenceNumber: value, Token: token}, false)
 }
 
-func (al *AerospikeCheckpointer) GetCheckpoint(key string) (string, error) {
+// Fence raises the token bin of the key's record, creating the record if needed. A record that only has a token has
+// no checkpoint yet.
+func (al *AerospikeCheckpointer) Fence(key shardkey.ShardKey, token int64) error {
+	asKey, err := aerospike.NewKey(al.namespace, setName, key.String())
+	if err != nil {
+		return err
+	}
+
 	errTries := 0
 	for {
-		val, err := al.get(key)
+		err = al.fence(asKey, token)
+		if err == nil || err == ErrStaleToken {
+			return err
+		}
+
+		// a concurrent write changed the generation, the token is checked again
+		errTries++
+		if errTries > waitRetries {
+			return err
+		}
+		time.Sleep(waitSleep)
+	}
+}
+
+func (al *AerospikeCheckpointer) fence(asKey *aerospike.Key, token int64) error {
+	record, err := al.client.Get(aerospike.NewPolicy(), asKey, "token")
+	if err != nil {
+		return err
+	}
+
+	policy := aerospike.NewWritePolicy(0, aerospikeTTL)
+	if record != nil {
+		if current := binInt64(record.Bins["token"]); current > token {
+			return ErrStaleToken
+		} else if current == token {
+			return nil
+		}
+		policy.Generation = record.Generation
+		policy.GenerationPolicy = aerospike.EXPECT_GEN_EQUAL
+	} else {
+		policy.RecordExistsAction = aerospike.CREATE_ONLY
+	}
+
+	return al.client.PutBins(policy, asKey, aerospike.NewBin("token", token))
+}
+
+func (al *AerospikeCheckpointer) SetCheckpointDetails(key shardkey.ShardKey, checkpoint *Checkpoint) error {
+	return al.setWithRetries(key, checkpoint, false)
+}
+
+func (al *AerospikeCheckpointer) getWithRetries(key shardkey.ShardKey) (*aerospike.Record, error) {
+	errTries := 0
+	for {
+		record, err := al.get(key.String())
+		if err == nil && decodeCheckpoint(record) == nil && key.Namespace == "" {
+			record, err = al.get(key.Legacy())
+		}
 		if err != nil {
 			errTries++
 			if errTries > waitRetries {
-				return "", err
+				return nil, err
 			}
 			time.Sleep(waitSleep)
 			continue
 		}
-		return val, nil
+		return record, nil
 	}
 }
 
-func (al *AerospikeCheckpointer) SetCheckpoint(key, value string) error {
+func (al *AerospikeCheckpointer) setWithRetries(key shardkey.ShardKey, checkpoint *Checkpoint, force bool) error {
 	var err error
 
 	errTries := 0
 	for {
-		err = al.set(key, value)
-		if err != nil {
+		err = al.set(key, checkpoint, force)
+		if err == ErrStaleToken || err == ErrCheckpointRewind || err == ErrInvalidSequenceNumber {
+			return err
+		} else if err != nil {
 			errTries++
 			if errTries > waitRetries {
 				return err
@@ -65,52 +178,254 @@ func (al *AerospikeCheckpointer) SetCheckpoint(key, value string) error {
 	}
 }
 
-func (al *AerospikeCheckpointer) get(key string) (string, error) {
-	asKey, err := aerospike.NewKey(al.namespace, setName, key)
+// ListCheckpoints scans the checkpoint set. Only checkpoints written since keys are stored in the record are listed.
+// Legacy checkpoints are listed without a namespace unless the key already has a checkpoint in the new format.
+func (al *AerospikeCheckpointer) ListCheckpoints(filter shardkey.ShardKey) (map[shardkey.ShardKey]string, error) {
+	recordset, err := al.client.ScanAll(aerospike.NewScanPolicy(), al.namespace, setName, "key", "checkpoint")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer recordset.Close()
 
-	record, err := al.client.Get(aerospike.NewPolicy(), asKey, setName, "checkpoint")
-	if err != nil {
-		return "", err
+	checkpoints := map[shardkey.ShardKey]string{}
+	legacy := map[shardkey.ShardKey]string{}
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+
+		encoded, ok := res.Record.Bins["key"].(string)
+		if !ok {
+			continue
+		}
+
+		checkpoint, _ := res.Record.Bins["checkpoint"].(string)
+		if key, err := shardkey.Parse(encoded); err == nil {
+			if key.Matches(filter) {
+				checkpoints[key] = checkpoint
+			}
+		} else if key, err := shardkey.ParseLegacy(encoded); err == nil && key.Matches(filter) {
+			legacy[key] = checkpoint
+		}
 	}
 
-	if record == nil {
-		return "", nil
+	for key, checkpoint := range legacy {
+		if _, ok := checkpoints[key]; !ok {
+			checkpoints[key] = checkpoint
+		}
 	}
 
-	binContent, ok := record.Bins["checkpoint"]
-	if ok {
-		return binContent.(string), nil
+	return checkpoints, nil
+}
+
+// DeleteCheckpoint deletes the checkpoint of the key together with its legacy checkpoint, which would be read again
+// otherwise.
+func (al *AerospikeCheckpointer) DeleteCheckpoint(key shardkey.ShardKey) error {
+	names := []string{key.String()}
+	if key.Namespace == "" {
+		names = append(names, key.Legacy())
+	}
+
+	for _, name := range names {
+		asKey, err := aerospike.NewKey(al.namespace, setName, name)
+		if err != nil {
+			return err
+		}
+
+		_, err = al.client.Delete(nil, asKey)
+		if err != nil {
+			return err
+		}
 	}
-	return "", nil
+
+	return nil
 }
 
-func (al *AerospikeCheckpointer) set(key, value string) error {
+func (al *AerospikeCheckpointer) get(key string) (*aerospike.Record, error) {
 	asKey, err := aerospike.NewKey(al.namespace, setName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return al.client.Get(aerospike.NewPolicy(), asKey)
+}
+
+// set validates the checkpoint against the current record and writes it only if the record didn't change in the
+// meantime. A concurrent write makes the generation check fail and the whole check is retried.
+func (al *AerospikeCheckpointer) set(key shardkey.ShardKey, checkpoint *Checkpoint, force bool) error {
+	asKey, err := aerospike.NewKey(al.namespace, setName, key.String())
 	if err != nil {
 		return err
 	}
 
-	hostname, err := os.Hostname()
+	record, err := al.client.Get(aerospike.NewPolicy(), asKey)
+	if err != nil {
+		return err
+	}
+
+	if record != nil && checkpoint.Token > 0 && binInt64(record.Bins["token"]) > checkpoint.Token {
+		return ErrStaleToken
+	}
+
+	err = validateCheckpoint(decodeCheckpoint(record), checkpoint, force)
 	if err != nil {
 		return err
 	}
 
 	policy := aerospike.NewWritePolicy(0, aerospikeTTL)
-	policy.RecordExistsAction = aerospike.UPDATE
+	if record != nil {
+		policy.Generation = record.Generation
+		policy.GenerationPolicy = aerospike.EXPECT_GEN_EQUAL
+	} else {
+		policy.RecordExistsAction = aerospike.CREATE_ONLY
+	}
 
-	err = al.client.PutBins(
-		policy,
-		asKey,
-		aerospike.NewBin("hostname", hostname),
-		aerospike.NewBin("updated", time.Now().UTC().Format(time.RFC3339)),
-		aerospike.NewBin("checkpoint", value),
-	)
+	hostname, err := os.Hostname()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	written := *checkpoint
+	written.Timestamp = time.Now().UTC()
+	if written.Owner == "" {
+		written.Owner = hostname
+	}
+
+	entry := encodeCheckpoint(&written)
+	history := appendHistory(entry, record, al.historySize)
+
+	bins := []*aerospike.Bin{
+		aerospike.NewBin("key", key.String()),
+		aerospike.NewBin("hostname", hostname),
+		aerospike.NewBin("history", history),
+	}
+	for name, value := range entry {
+		bins = append(bins, aerospike.NewBin(name, value))
+	}
+
+	return al.client.PutBins(policy, asKey, bins...)
+}
+
+// appendHistory puts entry in front of the history of the record and keeps at most size entries.
+func appendHistory(entry map[string]interface{}, record *aerospike.Record, size int) []interface{} {
+	history := []interface{}{entry}
+	for _, previous := range recordHistory(record) {
+		if len(history) >= size {
+			break
+		}
+		history = append(history, previous)
+	}
+	return history
+}
+
+// encodeCheckpoint returns the bins of a checkpoint. The same map is stored as an entry of the history.
+func encodeCheckpoint(checkpoint *Checkpoint) map[string]interface{} {
+	entry := map[string]interface{}{
+		"checkpoint":  checkpoint.SequenceNumber,
+		"subsequence": checkpoint.SubSequenceNumber,
+		"owner":       checkpoint.Owner,
+		"updated":     checkpoint.Timestamp.Format(time.RFC3339Nano),
+	}
+	if checkpoint.Token > 0 {
+		entry["token"] = checkpoint.Token
+	}
+	// written even when unknown so the arrival time of the previous checkpoint isn't left in the bins
+	entry["arrival"] = ""
+	if !checkpoint.ArrivalTime.IsZero() {
+		entry["arrival"] = checkpoint.ArrivalTime.UTC().Format(time.RFC3339Nano)
+	}
+	return entry
+}
+
+// decodeCheckpoint returns the current checkpoint of a record or nil if it has none. It's the newest history entry
+// since the token bin keeps the greatest token of all writes. Records written before the history was kept are
+// decoded from their bins and owned by their hostname.
+func decodeCheckpoint(record *aerospike.Record) *Checkpoint {
+	if record == nil {
+		return nil
+	}
+	if _, ok := record.Bins["checkpoint"].(string); !ok {
+		return nil
+	}
+
+	if history := historyEntries(record); len(history) > 0 {
+		return decodeEntry(history[0])
+	}
+
+	checkpoint := decodeEntry(record.Bins)
+	checkpoint.Owner, _ = record.Bins["hostname"].(string)
+	return checkpoint
+}
+
+func decodeEntry(entry map[string]interface{}) *Checkpoint {
+	checkpoint := &Checkpoint{
+		SubSequenceNumber: binInt64(entry["subsequence"]),
+		Token:             binInt64(entry["token"]),
+		Timestamp:         binTime(entry["updated"]),
+		ArrivalTime:       binTime(entry["arrival"]),
+	}
+	checkpoint.SequenceNumber, _ = entry["checkpoint"].(string)
+	checkpoint.Owner, _ = entry["owner"].(string)
+	return checkpoint
+}
+
+// recordHistory returns the history entries of a record, the newest first. A record written before the history was
+// kept starts it with its current checkpoint.
+func recordHistory(record *aerospike.Record) []map[string]interface{} {
+	if record == nil {
+		return nil
+	}
+
+	history := historyEntries(record)
+	if len(history) == 0 {
+		if current := decodeCheckpoint(record); current != nil {
+			return []map[string]interface{}{encodeCheckpoint(current)}
+		}
+	}
+	return history
+}
+
+func historyEntries(record *aerospike.Record) []map[string]interface{} {
+	list, _ := record.Bins["history"].([]interface{})
+
+	history := []map[string]interface{}{}
+	for _, item := range list {
+		switch entry := item.(type) {
+		case map[string]interface{}:
+			history = append(history, entry)
+		case map[interface{}]interface{}:
+			converted := map[string]interface{}{}
+			for name, value := range entry {
+				if name, ok := name.(string); ok {
+					converted[name] = value
+				}
+			}
+			history = append(history, converted)
+		}
+	}
+	return history
+}
+
+func binInt64(value interface{}) int64 {
+	switch value := value.(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	}
+	return 0
+}
+
+func binTime(value interface{}) time.Time {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}
+	}
+
+	// RFC3339Nano parses timestamps with and without fractional seconds
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
 }
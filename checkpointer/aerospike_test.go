@@ -0,0 +1,107 @@
+package checkpointer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aerospike/aerospike-client-go"
+)
+
+// writeRecord returns the record as it's stored after the checkpoint was set on record. History entries are read back
+// with interface{} keys like the Aerospike client returns maps.
+func writeRecord(record *aerospike.Record, checkpoint *Checkpoint, historySize int) *aerospike.Record {
+	entry := encodeCheckpoint(checkpoint)
+
+	history := []interface{}{}
+	for _, item := range appendHistory(entry, record, historySize) {
+		read := map[interface{}]interface{}{}
+		for name, value := range item.(map[string]interface{}) {
+			read[name] = value
+		}
+		history = append(history, read)
+	}
+
+	bins := aerospike.BinMap{"history": history}
+	for name, value := range entry {
+		bins[name] = value
+	}
+	return &aerospike.Record{Bins: bins}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	updated := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var record *aerospike.Record
+	for i := 1; i <= 15; i++ {
+		record = writeRecord(record, &Checkpoint{
+			SequenceNumber: strconv.Itoa(i),
+			Owner:          "host-" + strconv.Itoa(i%2),
+			Token:          int64(i),
+			Timestamp:      updated.Add(time.Duration(i) * time.Second),
+		}, 10)
+	}
+
+	history := recordHistory(record)
+	if len(history) != 10 {
+		t.Fatalf("History has %d entries, expected 10", len(history))
+	}
+	for i, entry := range history {
+		checkpoint := decodeEntry(entry)
+		expected := strconv.Itoa(15 - i)
+		if checkpoint.SequenceNumber != expected {
+			t.Errorf("Entry %d is checkpoint %s, expected %s", i, checkpoint.SequenceNumber, expected)
+		}
+	}
+
+	current := decodeCheckpoint(record)
+	if current.SequenceNumber != "15" || current.Owner != "host-1" || current.Token != 15 ||
+		!current.Timestamp.Equal(updated.Add(15*time.Second)) {
+		t.Errorf("Got current checkpoint %+v, expected 15 written by host-1", current)
+	}
+}
+
+func TestLegacyRecordStartsHistory(t *testing.T) {
+	legacy := &aerospike.Record{Bins: aerospike.BinMap{
+		"checkpoint": "10",
+		"hostname":   "old-host",
+		"updated":    "2018-01-01T00:00:00Z",
+	}}
+
+	current := decodeCheckpoint(legacy)
+	if current == nil || current.SequenceNumber != "10" || current.Owner != "old-host" {
+		t.Fatalf("Got %+v, expected checkpoint 10 owned by old-host", current)
+	}
+
+	record := writeRecord(legacy, &Checkpoint{SequenceNumber: "11", Owner: "new-host"}, 10)
+	history := recordHistory(record)
+	if len(history) != 2 {
+		t.Fatalf("History has %d entries, expected 2", len(history))
+	}
+	if previous := decodeEntry(history[1]); previous.SequenceNumber != "10" || previous.Owner != "old-host" {
+		t.Errorf("Got previous checkpoint %+v, expected 10 owned by old-host", previous)
+	}
+}
+
+func TestEncodeCheckpointRoundTrip(t *testing.T) {
+	checkpoint := &Checkpoint{
+		SequenceNumber:    "49590338271490256608559692538361571095921575989136588898",
+		SubSequenceNumber: 3,
+		Owner:             "host",
+		Token:             7,
+		Timestamp:         time.Date(2018, 1, 1, 0, 0, 0, 123, time.UTC),
+		ArrivalTime:       time.Date(2017, 12, 31, 23, 59, 0, 0, time.UTC),
+	}
+
+	decoded := decodeEntry(encodeCheckpoint(checkpoint))
+	if decoded.SequenceNumber != checkpoint.SequenceNumber || decoded.SubSequenceNumber != 3 ||
+		decoded.Owner != "host" || decoded.Token != 7 || !decoded.Timestamp.Equal(checkpoint.Timestamp) ||
+		!decoded.ArrivalTime.Equal(checkpoint.ArrivalTime) {
+		t.Errorf("Got %+v, expected %+v", decoded, checkpoint)
+	}
+
+	// the arrival time of a previous checkpoint must not stick to one without it
+	if decoded := decodeEntry(encodeCheckpoint(&Checkpoint{SequenceNumber: "1"})); !decoded.ArrivalTime.IsZero() {
+		t.Errorf("Got arrival time %v, expected none", decoded.ArrivalTime)
+	}
+}
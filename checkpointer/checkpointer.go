@@ -1,6 +1,68 @@
 package checkpointer
 
+import (
+	"errors"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+var (
+	ErrStaleToken            = errors.New("Stale fencing token")
+	ErrCheckpointRewind      = errors.New("Checkpoint behind current checkpoint")
+	ErrInvalidSequenceNumber = errors.New("Invalid sequence number")
+)
+
 type Checkpointer interface {
-	SetCheckpoint(key string, value string) error
-	GetCheckpoint(key string) (string, error)
+	// SetCheckpoint sets the checkpoint and returns ErrCheckpointRewind if it's behind the current one.
+	SetCheckpoint(key shardkey.ShardKey, value string) error
+	// ForceCheckpoint sets the checkpoint even if it's behind the current one, e.g. to reprocess records.
+	ForceCheckpoint(key shardkey.ShardKey, value string) error
+	GetCheckpoint(key shardkey.ShardKey) (string, error)
+}
+
+// FencedCheckpointer rejects checkpoint writes guarded by a fencing token older than the greatest token it has seen,
+// so a reader that lost its lock without noticing can't overwrite the progress of the new lock holder.
+type FencedCheckpointer interface {
+	Checkpointer
+	SetCheckpointFenced(key shardkey.ShardKey, value string, token int64) error
+	// Fence raises the token of the key without writing a checkpoint. A new lock holder calls it right after taking
+	// the lock so the previous holder is fenced off before the first checkpoint is written.
+	Fence(key shardkey.ShardKey, token int64) error
+}
+
+// ListableCheckpointer can enumerate and delete checkpoints, e.g. to find the consumer groups of a stream or to clean
+// up after a stream is deleted.
+type ListableCheckpointer interface {
+	Checkpointer
+	// ListCheckpoints returns the checkpoints whose keys match filter, see shardkey.ShardKey.Matches.
+	ListCheckpoints(filter shardkey.ShardKey) (map[shardkey.ShardKey]string, error)
+	DeleteCheckpoint(key shardkey.ShardKey) error
+}
+
+// Checkpoint is a checkpoint together with the metadata of the write that set it.
+type Checkpoint struct {
+	SequenceNumber string
+	// SubSequenceNumber is the position within an aggregated record, 0 for records that are not aggregated.
+	SubSequenceNumber int64
+	// Owner identifies the writer of the checkpoint. Checkpointers fill in the hostname when it's empty.
+	Owner string
+	// Token is the fencing token the checkpoint was written with, 0 for writes that were not fenced.
+	Token int64
+	// Timestamp is the time the checkpoint was written at. It's set by the checkpointer.
+	Timestamp time.Time
+	// ArrivalTime is the approximate arrival time of the checkpointed record in the stream, if known.
+	ArrivalTime time.Time
+}
+
+// DetailedCheckpointer stores checkpoints with their metadata and keeps a bounded history of every key so it can be
+// audited who moved a checkpoint and when.
+type DetailedCheckpointer interface {
+	Checkpointer
+	// SetCheckpointDetails sets the checkpoint like SetCheckpoint, or like SetCheckpointFenced when the token is set.
+	SetCheckpointDetails(key shardkey.ShardKey, checkpoint *Checkpoint) error
+	// GetCheckpointDetails returns the current checkpoint or nil if there is none.
+	GetCheckpointDetails(key shardkey.ShardKey) (*Checkpoint, error)
+	// CheckpointHistory returns the last checkpoints of the key, the newest first.
+	CheckpointHistory(key shardkey.ShardKey) ([]*Checkpoint, error)
 }
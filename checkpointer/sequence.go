@@ -0,0 +1,80 @@
+package checkpointer
+
+import (
+	"math/big"
+	"strings"
+)
+
+// positions of a shard that checkpoints are reset to by the admin API of kcl, e.g. kcl.CheckpointTrimHorizon
+const (
+	positionTrimHorizon       = "TRIM_HORIZON"
+	positionLatest            = "LATEST"
+	positionAtSequencePrefix  = "AT_SEQUENCE_NUMBER:"
+	positionAtTimestampPrefix = "AT_TIMESTAMP:"
+)
+
+// CompareSequenceNumbers compares two Kinesis sequence numbers, which are decimal numbers too big for uint64. It
+// returns -1, 0 or 1 when a is less than, equal to or greater than b.
+func CompareSequenceNumbers(a, b string) (int, error) {
+	x, ok := new(big.Int).SetString(a, 10)
+	if !ok {
+		return 0, ErrInvalidSequenceNumber
+	}
+
+	y, ok := new(big.Int).SetString(b, 10)
+	if !ok {
+		return 0, ErrInvalidSequenceNumber
+	}
+
+	return x.Cmp(y), nil
+}
+
+// IsSequenceNumber reports whether value is a valid sequence number.
+func IsSequenceNumber(value string) bool {
+	n, ok := new(big.Int).SetString(value, 10)
+	return ok && n.Sign() >= 0
+}
+
+// validateCheckpoint checks a checkpoint that would replace current, which is nil when the key has no checkpoint.
+// Unless forced the checkpoint has to be a sequence number that isn't behind current.
+func validateCheckpoint(current, checkpoint *Checkpoint, force bool) error {
+	if force {
+		return nil
+	}
+	if !IsSequenceNumber(checkpoint.SequenceNumber) {
+		return ErrInvalidSequenceNumber
+	}
+	if current == nil {
+		return nil
+	}
+
+	return checkMonotonic(current, checkpoint)
+}
+
+// checkMonotonic returns ErrCheckpointRewind when value is behind current. A checkpoint reset to a position of the
+// shard can't be ordered against sequence numbers and any value may follow it, except a reset to a sequence number
+// which is compared like a checkpoint. Other values that are not sequence numbers return ErrInvalidSequenceNumber.
+// Sub-sequence numbers order the records of an aggregated record.
+func checkMonotonic(current, value *Checkpoint) error {
+	currentNumber := current.SequenceNumber
+	switch {
+	case currentNumber == "", currentNumber == positionTrimHorizon, currentNumber == positionLatest,
+		strings.HasPrefix(currentNumber, positionAtTimestampPrefix):
+		if !IsSequenceNumber(value.SequenceNumber) {
+			return ErrInvalidSequenceNumber
+		}
+		return nil
+	case strings.HasPrefix(currentNumber, positionAtSequencePrefix):
+		currentNumber = strings.TrimPrefix(currentNumber, positionAtSequencePrefix)
+	}
+
+	cmp, err := CompareSequenceNumbers(value.SequenceNumber, currentNumber)
+	if err != nil {
+		return err
+	}
+	if cmp < 0 || cmp == 0 && value.SubSequenceNumber < current.SubSequenceNumber {
+		return ErrCheckpointRewind
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package checkpointer
+
+import (
+	"testing"
+)
+
+func TestCompareSequenceNumbers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+		err  error
+	}{
+		{"49590338271490256608559692538361571095921575989136588898", "49590338271490256608559692538361571095921575989136588898", 0, nil},
+		{"49590338271490256608559692538361571095921575989136588899", "49590338271490256608559692538361571095921575989136588898", 1, nil},
+		{"9", "10", -1, nil},
+		{"100000000000000000000000000000", "99999999999999999999999999999", 1, nil},
+		{"0010", "10", 0, nil},
+		{"009", "10", -1, nil},
+		{"abc", "10", 0, ErrInvalidSequenceNumber},
+		{"10", "", 0, ErrInvalidSequenceNumber},
+		{"10", "LATEST", 0, ErrInvalidSequenceNumber},
+	}
+
+	for _, test := range tests {
+		cmp, err := CompareSequenceNumbers(test.a, test.b)
+		if cmp != test.cmp || err != test.err {
+			t.Errorf("Comparing %s to %s: got %d and %v, expected %d and %v", test.a, test.b, cmp, err, test.cmp,
+				test.err)
+		}
+	}
+}
+
+func TestValidateCheckpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		current *Checkpoint
+		value   *Checkpoint
+		force   bool
+		err     error
+	}{
+		{"first checkpoint", nil, &Checkpoint{SequenceNumber: "10"}, false, nil},
+		{"empty current", &Checkpoint{}, &Checkpoint{SequenceNumber: "10"}, false, nil},
+		{"forward", &Checkpoint{SequenceNumber: "10"}, &Checkpoint{SequenceNumber: "11"}, false, nil},
+		{"forward longer", &Checkpoint{SequenceNumber: "99"}, &Checkpoint{SequenceNumber: "100"}, false, nil},
+		{"equal", &Checkpoint{SequenceNumber: "10"}, &Checkpoint{SequenceNumber: "10"}, false, nil},
+		{"equal with leading zeros", &Checkpoint{SequenceNumber: "10"}, &Checkpoint{SequenceNumber: "0010"}, false, nil},
+		{"backward", &Checkpoint{SequenceNumber: "11"}, &Checkpoint{SequenceNumber: "10"}, false, ErrCheckpointRewind},
+		{"backward shorter", &Checkpoint{SequenceNumber: "100"}, &Checkpoint{SequenceNumber: "99"}, false, ErrCheckpointRewind},
+		{"sub-sequence forward", &Checkpoint{SequenceNumber: "10", SubSequenceNumber: 1}, &Checkpoint{SequenceNumber: "10", SubSequenceNumber: 2}, false, nil},
+		{"sub-sequence backward", &Checkpoint{SequenceNumber: "10", SubSequenceNumber: 2}, &Checkpoint{SequenceNumber: "10", SubSequenceNumber: 1}, false, ErrCheckpointRewind},
+		{"non-numeric value", &Checkpoint{SequenceNumber: "10"}, &Checkpoint{SequenceNumber: "abc"}, false, ErrInvalidSequenceNumber},
+		{"negative value", nil, &Checkpoint{SequenceNumber: "-1"}, false, ErrInvalidSequenceNumber},
+		{"non-numeric current", &Checkpoint{SequenceNumber: "abc"}, &Checkpoint{SequenceNumber: "10"}, false, ErrInvalidSequenceNumber},
+		{"reset to trim horizon", &Checkpoint{SequenceNumber: "TRIM_HORIZON"}, &Checkpoint{SequenceNumber: "10"}, false, nil},
+		{"reset to latest", &Checkpoint{SequenceNumber: "LATEST"}, &Checkpoint{SequenceNumber: "10"}, false, nil},
+		{"reset to timestamp", &Checkpoint{SequenceNumber: "AT_TIMESTAMP:2018-01-01T00:00:00Z"}, &Checkpoint{SequenceNumber: "10"}, false, nil},
+		{"reset to sequence number", &Checkpoint{SequenceNumber: "AT_SEQUENCE_NUMBER:10"}, &Checkpoint{SequenceNumber: "10"}, false, nil},
+		{"behind reset sequence number", &Checkpoint{SequenceNumber: "AT_SEQUENCE_NUMBER:10"}, &Checkpoint{SequenceNumber: "9"}, false, ErrCheckpointRewind},
+		{"forced backward", &Checkpoint{SequenceNumber: "11"}, &Checkpoint{SequenceNumber: "10"}, true, nil},
+		{"forced position", &Checkpoint{SequenceNumber: "11"}, &Checkpoint{SequenceNumber: "TRIM_HORIZON"}, true, nil},
+	}
+
+	for _, test := range tests {
+		err := validateCheckpoint(test.current, test.value, test.force)
+		if err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
@@ -12,7 +12,9 @@ import (
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	"github.com/matijavizintin/go-kcl/checkpointer"
 	"github.com/matijavizintin/go-kcl/locker"
+	"github.com/matijavizintin/go-kcl/registry"
 	"github.com/matijavizintin/go-kcl/snitcher"
+	"github.com/matijavizintin/go-kcl/spill"
 )
 
 var (
@@ -20,6 +22,11 @@ var (
 	ErrMissingCheckpointer = errors.New("Missing checkpointer")
 	ErrMissingSnitcher     = errors.New("Missing snitcher")
 	ErrShardLocked         = errors.New("Shard locked")
+	ErrLockLost            = locker.ErrLockLost
+	ErrStaleToken          = checkpointer.ErrStaleToken
+	ErrCheckpointRewind    = checkpointer.ErrCheckpointRewind
+
+	ErrMissingSchemaRegistry = errors.New("Missing schema registry")
 )
 
 var Logger = log.New(os.Stderr, "", log.LstdFlags)
@@ -27,12 +34,41 @@ var Logger = log.New(os.Stderr, "", log.LstdFlags)
 type Kinesis interface {
 	PutRecord(streamName, partitionKey string, record []byte) error
 	PutRecords(streamName string, records []*kinesis.PutRecordsRequestEntry) error
+	PutSchemaRecord(streamName, partitionKey, subject string, schema *registry.Schema, payload []byte) error
+	DecodeSchemaRecord(record *kinesis.Record) (*registry.Schema, []byte, error)
 
 	StreamDescription(streamName string) (*kinesis.StreamDescription, error)
+	ListShards(streamName string, filter *kinesis.ShardFilter) ([]*kinesis.Shard, error)
 	CreateStream(streamName string, shardCount int) error
 	UpdateStream(streamName string, shardsCount int) error
+	SplitShard(streamName, shardId, newStartingHashKey string) error
+	MergeShards(streamName, shardId, adjacentShardId string) error
 	DeleteStream(streamName string) error
+	DeleteStreamWithParameters(streamName string, purgeState bool) error
 	ListStreams() ([]string, error)
+	WaitUntilActive(streamName string) error
+	EnsureStream(spec *StreamSpec) error
+
+	IncreaseRetention(streamName string, hours int) error
+	DecreaseRetention(streamName string, hours int) error
+	EnableEncryption(streamName string, keyId string) error
+	DisableEncryption(streamName string) error
+	Tags(streamName string) (map[string]string, error)
+	AddTags(streamName string, tags map[string]string) error
+	RemoveTags(streamName string, keys []string) error
+	EnableEnhancedMonitoring(streamName string, metrics []string) error
+	DisableEnhancedMonitoring(streamName string, metrics []string) error
+
+	ResetCheckpointsToTrimHorizon(streamName, clientName string) (map[string]string, error)
+	ResetCheckpointsToLatest(streamName, clientName string) (map[string]string, error)
+	ResetCheckpointsToTimestamp(streamName, clientName string, ts time.Time) (map[string]string, error)
+	CopyCheckpoints(streamName, fromClientName, toClientName string) (map[string]string, error)
+	ConsumerGroups(streamName string) ([]string, error)
+	DeleteConsumerGroup(streamName, clientName string) error
+	CheckpointDetails(streamName, shardId, clientName string) (*checkpointer.Checkpoint, error)
+	CheckpointHistory(streamName, shardId, clientName string) ([]*checkpointer.Checkpoint, error)
+	ShardAssignments(streamName, clientName string) ([]*snitcher.Assignment, error)
+	LocalShardAssignments() ([]*snitcher.Assignment, error)
 
 	NewReader(streamName string, shardId string, clientName string) (*Reader, error)
 	NewReaderWithParameters(streamName string, shardId string, clientName string, streamReadInterval time.Duration, readBatchSize int, channelBufferSize int) (*Reader, error)
@@ -41,11 +77,26 @@ type Kinesis interface {
 	NewSharedReader(streamName string, clientName string) (*SharedReader, error)
 }
 
+// Codec transforms record payloads before they are put into a stream and after they are read from it, e.g.
+// envelope.Codec for client-side encryption.
+type Codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
 type Client struct {
 	kinesis    kinesisiface.KinesisAPI
 	distlock   locker.Locker
 	checkpoint checkpointer.Checkpointer
 	snitch     snitcher.Snitcher
+	schemas    registry.SchemaRegistry
+	codec      Codec
+	sampler    *TrafficSampler
+
+	keyNamespace string
+
+	spill     *spill.Queue
+	spillStop chan struct{}
 }
 
 func New(awsConfig *aws.Config, distlock locker.Locker, checkpoint checkpointer.Checkpointer, snitch snitcher.Snitcher) *Client {
@@ -57,21 +108,69 @@ func New(awsConfig *aws.Config, distlock locker.Locker, checkpoint checkpointer.
 	}
 }
 
+// SetSchemaRegistry sets the registry used to register schemas when producing and to resolve writer schemas when
+// decoding records.
+func (c *Client) SetSchemaRegistry(schemas registry.SchemaRegistry) {
+	c.schemas = schemas
+}
+
+// SetCodec sets the codec that encodes payloads in PutRecord and PutRecords and decodes them in readers. Readers stop
+// with the codec's error when a record cannot be decoded.
+func (c *Client) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+// SetKeyNamespace sets the namespace of the keys under which locks, checkpoints and shard ownership are stored so
+// multiple tenants can share the same backends. It has to be set before readers are created.
+func (c *Client) SetKeyNamespace(namespace string) {
+	c.keyNamespace = namespace
+}
+
 func (c *Client) PutRecord(streamName, partitionKey string, record []byte) error {
-	_, err := c.kinesis.PutRecord(&kinesis.PutRecordInput{
+	if c.codec != nil {
+		var err error
+		record, err = c.codec.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.spill != nil {
+		return c.putRecordSpilled(streamName, partitionKey, record)
+	}
+
+	out, err := c.kinesis.PutRecord(&kinesis.PutRecordInput{
 		Data:         record,
 		StreamName:   aws.String(streamName),
 		PartitionKey: aws.String(partitionKey),
 	})
 	if err != nil {
+		if c.sampler != nil && isThrottled(err) {
+			c.sampler.ObserveThrottle(streamName)
+		}
 		return err
 	}
 
+	if c.sampler != nil {
+		c.sampler.Observe(streamName, aws.StringValue(out.ShardId), len(record))
+	}
 	return nil
 }
 
 func (c *Client) PutRecords(streamName string, records []*kinesis.PutRecordsRequestEntry) error {
-	_, err := c.kinesis.PutRecords(&kinesis.PutRecordsInput{
+	if c.codec != nil {
+		var err error
+		records, err = c.encodeRecords(records)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.spill != nil {
+		return c.putRecordsSpilled(streamName, records)
+	}
+
+	out, err := c.kinesis.PutRecords(&kinesis.PutRecordsInput{
 		Records:    records,
 		StreamName: aws.String(streamName),
 	})
@@ -79,18 +178,66 @@ func (c *Client) PutRecords(streamName string, records []*kinesis.PutRecordsRequ
 		return err
 	}
 
+	c.sampleRecords(streamName, records, out)
 	return nil
 }
 
+// StreamDescription describes the stream including all of its shards. DescribeStream returns at most 100 shards per
+// call so the remaining shards are fetched page by page, for large streams prefer ListShards.
 func (c *Client) StreamDescription(streamName string) (*kinesis.StreamDescription, error) {
-	out, err := c.kinesis.DescribeStream(&kinesis.DescribeStreamInput{
-		StreamName: aws.String(streamName),
-	})
-	if err != nil {
-		return nil, err
+	var description *kinesis.StreamDescription
+
+	var exclusiveStartShardId *string
+	for {
+		out, err := c.kinesis.DescribeStream(&kinesis.DescribeStreamInput{
+			StreamName:            aws.String(streamName),
+			ExclusiveStartShardId: exclusiveStartShardId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if description == nil {
+			description = out.StreamDescription
+		} else {
+			description.Shards = append(description.Shards, out.StreamDescription.Shards...)
+		}
+
+		shards := out.StreamDescription.Shards
+		if !aws.BoolValue(out.StreamDescription.HasMoreShards) || len(shards) == 0 {
+			description.HasMoreShards = aws.Bool(false)
+			return description, nil
+		}
+		exclusiveStartShardId = shards[len(shards)-1].ShardId
+	}
+}
+
+// ListShards lists the shards of a stream following NextToken until all pages are read. The filter is optional and
+// restricts the result, e.g. to shards open at a timestamp (kinesis.ShardFilterTypeAtTimestamp) or to the currently
+// open shards (kinesis.ShardFilterTypeAtLatest).
+func (c *Client) ListShards(streamName string, filter *kinesis.ShardFilter) ([]*kinesis.Shard, error) {
+	res := []*kinesis.Shard{}
+
+	input := &kinesis.ListShardsInput{
+		StreamName:  aws.String(streamName),
+		ShardFilter: filter,
 	}
+	for {
+		out, err := c.kinesis.ListShards(input)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, out.Shards...)
+		if out.NextToken == nil {
+			return res, nil
+		}
 
-	return out.StreamDescription, nil
+		// the stream name and filter must not be set together with the token
+		input = &kinesis.ListShardsInput{
+			NextToken: out.NextToken,
+		}
+	}
 }
 
 func (c *Client) CreateStream(streamName string, shardCount int) error {
@@ -120,18 +267,55 @@ func (c *Client) DeleteStream(streamName string) error {
 func (c *Client) ListStreams() ([]string, error) {
 	res := []string{}
 
-	hasMore := true
-	for hasMore {
-		out, err := c.kinesis.ListStreams(&kinesis.ListStreamsInput{})
+	var exclusiveStartStreamName *string
+	for {
+		out, err := c.kinesis.ListStreams(&kinesis.ListStreamsInput{
+			ExclusiveStartStreamName: exclusiveStartStreamName,
+		})
 		if err != nil {
 			return nil, err
 		}
 
-		hasMore = *out.HasMoreStreams
 		for _, streamName := range out.StreamNames {
 			res = append(res, *streamName)
 		}
+
+		if !aws.BoolValue(out.HasMoreStreams) || len(out.StreamNames) == 0 {
+			return res, nil
+		}
+		exclusiveStartStreamName = out.StreamNames[len(out.StreamNames)-1]
+	}
+}
+
+// encodeRecords returns copies of the entries with encoded data so the caller's entries are left untouched.
+func (c *Client) encodeRecords(records []*kinesis.PutRecordsRequestEntry) ([]*kinesis.PutRecordsRequestEntry, error) {
+	encoded := make([]*kinesis.PutRecordsRequestEntry, 0, len(records))
+	for _, record := range records {
+		data, err := c.codec.Encode(record.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = append(encoded, &kinesis.PutRecordsRequestEntry{
+			Data:            data,
+			ExplicitHashKey: record.ExplicitHashKey,
+			PartitionKey:    record.PartitionKey,
+		})
+	}
+
+	return encoded, nil
+}
+
+func (c *Client) sampleRecords(streamName string, records []*kinesis.PutRecordsRequestEntry, out *kinesis.PutRecordsOutput) {
+	if c.sampler == nil {
+		return
 	}
 
-	return res, nil
+	for i, result := range out.Records {
+		if result.ErrorCode == nil {
+			c.sampler.Observe(streamName, aws.StringValue(result.ShardId), len(records[i].Data))
+		} else if *result.ErrorCode == kinesis.ErrCodeProvisionedThroughputExceededException {
+			c.sampler.ObserveThrottle(streamName)
+		}
+	}
 }
@@ -0,0 +1,148 @@
+package kcl
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// pagingKinesis returns streams and shards in pages of pageSize the way Kinesis does.
+type pagingKinesis struct {
+	kinesisiface.KinesisAPI
+
+	pageSize int
+	streams  []string
+	shards   []string
+}
+
+func (pk *pagingKinesis) ListStreams(input *kinesis.ListStreamsInput) (*kinesis.ListStreamsOutput, error) {
+	start := 0
+	if input.ExclusiveStartStreamName != nil {
+		start = indexOf(pk.streams, *input.ExclusiveStartStreamName) + 1
+	}
+	end := pk.pageEnd(start, len(pk.streams))
+
+	return &kinesis.ListStreamsOutput{
+		StreamNames:    aws.StringSlice(pk.streams[start:end]),
+		HasMoreStreams: aws.Bool(end < len(pk.streams)),
+	}, nil
+}
+
+func (pk *pagingKinesis) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	start := 0
+	if input.ExclusiveStartShardId != nil {
+		start = indexOf(pk.shards, *input.ExclusiveStartShardId) + 1
+	}
+	end := pk.pageEnd(start, len(pk.shards))
+
+	return &kinesis.DescribeStreamOutput{
+		StreamDescription: &kinesis.StreamDescription{
+			StreamName:    input.StreamName,
+			Shards:        pk.shardPage(start, end),
+			HasMoreShards: aws.Bool(end < len(pk.shards)),
+		},
+	}, nil
+}
+
+func (pk *pagingKinesis) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	start := 0
+	if input.NextToken != nil {
+		if input.StreamName != nil {
+			return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, "NextToken and StreamName set", nil)
+		}
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	end := pk.pageEnd(start, len(pk.shards))
+
+	out := &kinesis.ListShardsOutput{Shards: pk.shardPage(start, end)}
+	if end < len(pk.shards) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+func (pk *pagingKinesis) pageEnd(start, length int) int {
+	if start+pk.pageSize < length {
+		return start + pk.pageSize
+	}
+	return length
+}
+
+func (pk *pagingKinesis) shardPage(start, end int) []*kinesis.Shard {
+	shards := []*kinesis.Shard{}
+	for _, shardId := range pk.shards[start:end] {
+		shards = append(shards, &kinesis.Shard{ShardId: aws.String(shardId)})
+	}
+	return shards
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func newPagingKinesis() *pagingKinesis {
+	pk := &pagingKinesis{pageSize: 2}
+	for i := 0; i < 5; i++ {
+		pk.streams = append(pk.streams, fmt.Sprintf("stream-%d", i))
+		pk.shards = append(pk.shards, fmt.Sprintf("shardId-%012d", i))
+	}
+	return pk
+}
+
+func shardIds(shards []*kinesis.Shard) []string {
+	ids := []string{}
+	for _, shard := range shards {
+		ids = append(ids, aws.StringValue(shard.ShardId))
+	}
+	return ids
+}
+
+func TestListStreamsReadsAllPages(t *testing.T) {
+	pk := newPagingKinesis()
+
+	streams, err := (&Client{kinesis: pk}).ListStreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(streams, pk.streams) {
+		t.Errorf("Got %v, expected %v", streams, pk.streams)
+	}
+}
+
+func TestStreamDescriptionReadsAllPages(t *testing.T) {
+	pk := newPagingKinesis()
+
+	description, err := (&Client{kinesis: pk}).StreamDescription("stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := shardIds(description.Shards); !reflect.DeepEqual(ids, pk.shards) {
+		t.Errorf("Got %v, expected %v", ids, pk.shards)
+	}
+	if aws.BoolValue(description.HasMoreShards) {
+		t.Error("Description has more shards")
+	}
+}
+
+func TestListShardsReadsAllPages(t *testing.T) {
+	pk := newPagingKinesis()
+
+	shards, err := (&Client{kinesis: pk}).ListShards("stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := shardIds(shards); !reflect.DeepEqual(ids, pk.shards) {
+		t.Errorf("Got %v, expected %v", ids, pk.shards)
+	}
+}
@@ -0,0 +1,211 @@
+package envelope
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	envelopeVersion  byte = 1
+	maxKeyIdLength        = 255
+	maxWrappedLength      = 65535
+
+	defaultDataKeyAge  = 5 * time.Minute
+	defaultDataKeyUses = 100000
+	unwrappedCacheSize = 1000
+)
+
+// Codec encrypts payloads with AES-GCM data keys that are wrapped by a KeyProvider. Every payload carries an envelope
+//
+//	| version | key id length | key id | wrapped key length | wrapped key | nonce | ciphertext |
+//
+// where the header is authenticated together with the ciphertext. Data keys are reused for a limited time and number
+// of payloads so the provider is not called for every record.
+type Codec struct {
+	provider KeyProvider
+
+	maxKeyAge  time.Duration
+	maxKeyUses int
+
+	dataKey     *dataKey
+	dataKeyMu   sync.Mutex
+	unwrapped   map[string]cipher.AEAD
+	unwrappedMu sync.RWMutex
+}
+
+type dataKey struct {
+	header  []byte
+	aead    cipher.AEAD
+	created time.Time
+	uses    int
+}
+
+func NewCodec(provider KeyProvider) *Codec {
+	return NewCodecWithParameters(provider, defaultDataKeyAge, defaultDataKeyUses)
+}
+
+// NewCodecWithParameters creates a codec that generates a new data key after maxKeyAge or after maxKeyUses payloads
+// were encrypted with the current one.
+func NewCodecWithParameters(provider KeyProvider, maxKeyAge time.Duration, maxKeyUses int) *Codec {
+	return &Codec{
+		provider:   provider,
+		maxKeyAge:  maxKeyAge,
+		maxKeyUses: maxKeyUses,
+		unwrapped:  map[string]cipher.AEAD{},
+	}
+}
+
+// Rotate discards the current data key so the next payload is encrypted with a key wrapped by the provider's current
+// master key.
+func (c *Codec) Rotate() {
+	c.dataKeyMu.Lock()
+	c.dataKey = nil
+	c.dataKeyMu.Unlock()
+}
+
+func (c *Codec) Encode(plaintext []byte) ([]byte, error) {
+	key, err := c.currentDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := key.aead.NonceSize()
+	data := make([]byte, len(key.header)+nonceSize, len(key.header)+nonceSize+len(plaintext)+key.aead.Overhead())
+	copy(data, key.header)
+
+	nonce := data[len(key.header):]
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.aead.Seal(data, nonce, plaintext, key.header), nil
+}
+
+// Decode decrypts a payload created by Encode. Any payload that fails authentication is rejected.
+func (c *Codec) Decode(data []byte) ([]byte, error) {
+	keyId, wrapped, headerLength, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := c.unwrap(keyId, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < headerLength+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidEnvelope
+	}
+
+	header := data[:headerLength]
+	nonce := data[headerLength : headerLength+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[headerLength+aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return plaintext, nil
+}
+
+func (c *Codec) currentDataKey() (*dataKey, error) {
+	c.dataKeyMu.Lock()
+	defer c.dataKeyMu.Unlock()
+
+	if c.dataKey != nil && c.dataKey.uses < c.maxKeyUses && time.Since(c.dataKey.created) < c.maxKeyAge {
+		c.dataKey.uses++
+		return c.dataKey, nil
+	}
+
+	generated, err := c.provider.GenerateDataKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(generated.KeyId) == 0 || len(generated.KeyId) > maxKeyIdLength || len(generated.Wrapped) > maxWrappedLength {
+		return nil, ErrInvalidKey
+	}
+
+	aead, err := newAEAD(generated.Plaintext)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	c.dataKey = &dataKey{
+		header:  newHeader(generated.KeyId, generated.Wrapped),
+		aead:    aead,
+		created: time.Now(),
+		uses:    1,
+	}
+	return c.dataKey, nil
+}
+
+// unwrap returns the cipher for a wrapped data key. Unwrapped keys are cached since consecutive records usually share
+// a data key.
+func (c *Codec) unwrap(keyId string, wrapped []byte) (cipher.AEAD, error) {
+	cacheKey := keyId + "\x00" + string(wrapped)
+
+	c.unwrappedMu.RLock()
+	aead, ok := c.unwrapped[cacheKey]
+	c.unwrappedMu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	plaintext, err := c.provider.DecryptDataKey(keyId, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err = newAEAD(plaintext)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	c.unwrappedMu.Lock()
+	if len(c.unwrapped) >= unwrappedCacheSize {
+		c.unwrapped = map[string]cipher.AEAD{}
+	}
+	c.unwrapped[cacheKey] = aead
+	c.unwrappedMu.Unlock()
+
+	return aead, nil
+}
+
+func newHeader(keyId string, wrapped []byte) []byte {
+	header := make([]byte, 0, 4+len(keyId)+len(wrapped))
+	header = append(header, envelopeVersion, byte(len(keyId)))
+	header = append(header, keyId...)
+	header = append(header, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(wrapped)))
+	header = append(header, wrapped...)
+
+	return header
+}
+
+func parseHeader(data []byte) (string, []byte, int, error) {
+	if len(data) < 2 || data[0] != envelopeVersion {
+		return "", nil, 0, ErrInvalidEnvelope
+	}
+
+	offset := 2
+	keyIdLength := int(data[1])
+	if len(data) < offset+keyIdLength+2 {
+		return "", nil, 0, ErrInvalidEnvelope
+	}
+	keyId := string(data[offset : offset+keyIdLength])
+	offset += keyIdLength
+
+	wrappedLength := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	offset += 2
+	if len(data) < offset+wrappedLength {
+		return "", nil, 0, ErrInvalidEnvelope
+	}
+	wrapped := data[offset : offset+wrappedLength]
+	offset += wrappedLength
+
+	return keyId, wrapped, offset, nil
+}
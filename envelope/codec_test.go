@@ -0,0 +1,114 @@
+package envelope
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestProvider(t *testing.T, keyIds ...string) *StaticKeyProvider {
+	keys := map[string][]byte{}
+	for i, keyId := range keyIds {
+		keys[keyId] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+
+	provider, err := NewStaticKeyProvider(keyIds[0], keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codec := NewCodec(newTestProvider(t, "master-1"))
+
+	for _, plaintext := range [][]byte{{}, []byte("payload"), bytes.Repeat([]byte("x"), 100000)} {
+		data, err := codec.Encode(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plaintext) > 0 && bytes.Contains(data, plaintext) {
+			t.Error("Envelope contains the plaintext")
+		}
+
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, plaintext) {
+			t.Errorf("Decoded %d bytes, expected %d", len(decoded), len(plaintext))
+		}
+	}
+
+	first, _ := codec.Encode([]byte("payload"))
+	second, _ := codec.Encode([]byte("payload"))
+	if bytes.Equal(first, second) {
+		t.Error("Equal payloads have equal envelopes")
+	}
+}
+
+func TestCodecDecodesRotatedKeys(t *testing.T) {
+	provider := newTestProvider(t, "master-1", "master-2")
+	codec := NewCodec(provider)
+
+	old, err := codec.Encode([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = provider.SetCurrentKey("master-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec.Rotate()
+
+	current, err := codec.Encode([]byte("current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyId, _, _, _ := parseHeader(current); keyId != "master-2" {
+		t.Errorf("Payload was encrypted with %s after rotation", keyId)
+	}
+
+	// a reader without cached data keys unwraps them with the master key named in the envelope
+	reader := NewCodec(provider)
+	for expected, data := range map[string][]byte{"old": old, "current": current} {
+		decoded, err := reader.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != expected {
+			t.Errorf("Decoded %q, expected %q", decoded, expected)
+		}
+	}
+
+	_, err = NewCodec(newTestProvider(t, "master-3")).Decode(old)
+	if err != ErrUnknownKey {
+		t.Errorf("Got %v, expected %v", err, ErrUnknownKey)
+	}
+}
+
+func TestCodecRejectsTamperedEnvelopes(t *testing.T) {
+	provider := newTestProvider(t, "master-1")
+	data, err := NewCodec(provider).Encode([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every byte is covered, the header by the associated data and the wrapped key by its own authentication
+	for i := range data {
+		tampered := append([]byte{}, data...)
+		tampered[i] ^= 0x01
+
+		plaintext, err := NewCodec(provider).Decode(tampered)
+		if err == nil || plaintext != nil {
+			t.Errorf("Envelope with byte %d flipped was decoded", i)
+		}
+	}
+
+	for length := 0; length < len(data); length++ {
+		_, err := NewCodec(provider).Decode(data[:length])
+		if err == nil {
+			t.Errorf("Envelope truncated to %d bytes was decoded", length)
+		}
+	}
+}
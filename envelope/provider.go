@@ -0,0 +1,26 @@
+package envelope
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnknownKey           = errors.New("Unknown key")
+	ErrInvalidKey           = errors.New("Invalid key")
+	ErrInvalidEnvelope      = errors.New("Invalid envelope")
+	ErrAuthenticationFailed = errors.New("Envelope authentication failed")
+)
+
+type DataKey struct {
+	// KeyId identifies the master key that wrapped this data key.
+	KeyId     string
+	Plaintext []byte
+	Wrapped   []byte
+}
+
+type KeyProvider interface {
+	// GenerateDataKey returns a new AES-256 data key in plaintext and wrapped with the current master key.
+	GenerateDataKey() (*DataKey, error)
+	// DecryptDataKey unwraps a data key that was wrapped with the master key keyId.
+	DecryptDataKey(keyId string, wrapped []byte) ([]byte, error)
+}
@@ -0,0 +1,125 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+const dataKeySize = 32
+
+// StaticKeyProvider wraps data keys with master keys held in memory. It is meant for tests and local development,
+// production deployments should use a provider backed by a KMS. Keys are rotated by adding a new key and making it
+// current, old keys have to be kept as long as records encrypted with them are in the stream.
+type StaticKeyProvider struct {
+	keys    map[string]cipher.AEAD
+	current string
+	mu      sync.RWMutex
+}
+
+func NewStaticKeyProvider(currentKeyId string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	sp := &StaticKeyProvider{
+		keys: map[string]cipher.AEAD{},
+	}
+
+	for keyId, key := range keys {
+		err := sp.AddKey(keyId, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := sp.SetCurrentKey(currentKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	return sp, nil
+}
+
+// AddKey adds a master key that can be used to unwrap data keys. The key has to be 16, 24 or 32 bytes long.
+func (sp *StaticKeyProvider) AddKey(keyId string, key []byte) error {
+	if keyId == "" || len(keyId) > maxKeyIdLength {
+		return ErrInvalidKey
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return ErrInvalidKey
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.keys[keyId] = aead
+	return nil
+}
+
+// SetCurrentKey sets the master key used to wrap new data keys.
+func (sp *StaticKeyProvider) SetCurrentKey(keyId string) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if _, ok := sp.keys[keyId]; !ok {
+		return ErrUnknownKey
+	}
+
+	sp.current = keyId
+	return nil
+}
+
+func (sp *StaticKeyProvider) GenerateDataKey() (*DataKey, error) {
+	sp.mu.RLock()
+	keyId := sp.current
+	aead := sp.keys[keyId]
+	sp.mu.RUnlock()
+
+	plaintext := make([]byte, dataKeySize)
+	_, err := io.ReadFull(rand.Reader, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		KeyId:     keyId,
+		Plaintext: plaintext,
+		Wrapped:   aead.Seal(nonce, nonce, plaintext, []byte(keyId)),
+	}, nil
+}
+
+func (sp *StaticKeyProvider) DecryptDataKey(keyId string, wrapped []byte) ([]byte, error) {
+	sp.mu.RLock()
+	aead, ok := sp.keys[keyId]
+	sp.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrInvalidEnvelope
+	}
+
+	plaintext, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyId))
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
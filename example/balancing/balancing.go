@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+	"github.com/matijavizintin/go-kcl/snitcher"
+)
+
+const (
+	workers   = 3
+	shards    = 8
+	maxShards = 4
+	interval  = 100 * time.Millisecond
+)
+
+// Simulates workers balancing the shards of a stream in one process. Shard 0 is hot, the throughput strategy gives
+// its owner fewer other shards.
+func main() {
+	store := snitcher.NewMemoryStore(5 * interval)
+
+	keys := []shardkey.ShardKey{}
+	for i := 0; i < shards; i++ {
+		keys = append(keys, shardkey.New("", "Demo", fmt.Sprintf("shardId-%012d", i), "balancing"))
+	}
+
+	snitchers := []*snitcher.BalancingSnitcher{}
+	for i := 0; i < workers; i++ {
+		strategy := snitcher.NewMaxShardsStrategy(snitcher.NewThroughputStrategyWithParameters(time.Second, 64*1024), maxShards)
+		s := snitcher.NewBalancingSnitcherWithParameters(store, strategy, interval)
+		for _, key := range keys {
+			s.RegisterKey(key)
+		}
+		snitchers = append(snitchers, s)
+	}
+
+	for round := 0; round < 30; round++ {
+		time.Sleep(interval)
+
+		for i, s := range snitchers {
+			owned := []string{}
+			for j, key := range keys {
+				if !s.CheckOwnership(key) {
+					continue
+				}
+				owned = append(owned, key.ShardId)
+
+				// the owner reads the shard, shard 0 gets 10 times the traffic of the others
+				bytes := 1024
+				if j == 0 {
+					bytes *= 10
+				}
+				s.Observe(key, bytes)
+			}
+			sort.Strings(owned)
+			log.Printf("worker %d: %s", i, strings.Join(owned, ", "))
+		}
+	}
+
+	assignments, err := snitchers[0].ClusterAssignments()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, assignment := range assignments {
+		log.Printf("%s: owner %s, weight %.2f, cost %.2f", assignment.Key.ShardId, assignment.ClientId, assignment.Weight, assignment.Cost)
+	}
+
+	for _, s := range snitchers {
+		s.Close()
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/aerospike/aerospike-client-go"
 	"github.com/aws/aws-sdk-go/aws"
@@ -38,6 +39,9 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// hand the shards over to other readers on SIGTERM, the records channel is closed once they took over
+	reader.DrainOnSignal(30 * time.Second)
+
 	for range reader.Records() {
 		//log.Print("Data: ", string(m.Data))
 
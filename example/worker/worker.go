@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aerospike/aerospike-client-go"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+
+	"github.com/matijavizintin/go-kcl"
+	"github.com/matijavizintin/go-kcl/checkpointer"
+	"github.com/matijavizintin/go-kcl/locker"
+	"github.com/matijavizintin/go-kcl/snitcher"
+)
+
+const (
+	aerospikeNamespace = "kinesis"
+	streamName         = "kcl-example"
+	clientName         = "kcl-test-client"
+)
+
+type printProcessor struct {
+	shardId string
+}
+
+func (p *printProcessor) Initialize(shard *kcl.ShardInfo) error {
+	p.shardId = shard.ShardId
+	log.Printf("Processing shard %s from checkpoint %q", shard.ShardId, shard.Checkpoint)
+	return nil
+}
+
+func (p *printProcessor) ProcessRecords(records []*kinesis.Record, checkpointer kcl.RecordProcessorCheckpointer) error {
+	for _, record := range records {
+		log.Printf("Record read from %s: %s", p.shardId, string(record.Data))
+	}
+
+	return checkpointer.Checkpoint()
+}
+
+func (p *printProcessor) LeaseLost() {
+	log.Printf("Shard %s taken over by another worker", p.shardId)
+}
+
+func (p *printProcessor) ShardEnded(checkpointer kcl.RecordProcessorCheckpointer) error {
+	log.Printf("Shard %s ended", p.shardId)
+	return nil
+}
+
+func (p *printProcessor) ShutdownRequested(checkpointer kcl.RecordProcessorCheckpointer) error {
+	log.Printf("Shard %s shutting down", p.shardId)
+	return nil
+}
+
+func main() {
+	region, ok := os.LookupEnv("KCL_AWS_REGION")
+	if !ok {
+		log.Fatal("KCL_AWS_REGION not set")
+	}
+	id, ok := os.LookupEnv("KCL_AWS_ID")
+	if !ok {
+		log.Fatal("KCL_AWS_ID not set")
+	}
+	secret, ok := os.LookupEnv("KCL_AWS_SECRET")
+	if !ok {
+		log.Fatal("KCL_AWS_SECRET not set")
+	}
+	asHostname, ok := os.LookupEnv("KCL_AS_HOSTNAME")
+	if !ok {
+		log.Fatal("KCL_AS_HOSTNAME not set")
+	}
+
+	asClient, err := aerospike.NewClient(asHostname, 3000)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	aerospikeLocker := locker.NewAearospikeLocker(asClient, aerospikeNamespace)
+	aerospikeCheckpointer := checkpointer.NewAerospikeCheckpointer(asClient, aerospikeNamespace)
+	aerospikeSnitcher := snitcher.NewAerospikeSnitcher(asClient, aerospikeNamespace)
+
+	awsConfig := &aws.Config{
+		Region: aws.String(region),
+		Credentials: credentials.NewStaticCredentials(
+			id,
+			secret,
+			"",
+		),
+	}
+
+	client := kcl.New(awsConfig, aerospikeLocker, aerospikeCheckpointer, aerospikeSnitcher)
+
+	worker, err := client.NewWorker(streamName, clientName, func(shard *kcl.ShardInfo) kcl.RecordProcessor {
+		return &printProcessor{}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		worker.Shutdown()
+	}()
+
+	err = worker.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Worker stopped")
+}
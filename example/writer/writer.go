@@ -47,10 +47,15 @@ func main() {
 
 	client := kcl.New(awsConfig, nil, nil, nil)
 
-	err := createStreamIfNecessary(client)
+	// creates the stream if necessary and waits until it's ready to accept records
+	err := client.EnsureStream(&kcl.StreamSpec{
+		Name:       streamName,
+		ShardCount: shardsCount,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("Stream %s with %d shards is active.", streamName, shardsCount)
 
 	for range time.Tick(insertionInterval) {
 		// put random records in the shards every insertionInterval
@@ -63,32 +68,6 @@ func main() {
 	}
 }
 
-func createStreamIfNecessary(client *kcl.Client) error {
-	streams, err := client.ListStreams()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	found := false
-	for _, name := range streams {
-		if name == streamName {
-			found = true
-			break
-		}
-	}
-
-	if !found {
-		err = client.CreateStream(streamName, shardsCount)
-		if err != nil {
-			return err
-		}
-
-		log.Printf("Stream %s with %d shards successfully created.", streamName, shardsCount)
-
-	}
-	return nil
-}
-
 func prepareBatch() []*kinesis.PutRecordsRequestEntry {
 	batch := []*kinesis.PutRecordsRequestEntry{}
 
@@ -0,0 +1,399 @@
+package kcl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/matijavizintin/go-kcl/checkpointer"
+	"github.com/matijavizintin/go-kcl/locker"
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+// fakeKinesis serves the shards of a single stream from memory. Iterators are the shard id and the index of the next
+// record. Sequence numbers are decimal numbers that grow within a shard.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+
+	shards  []*fakeShard
+	shardMu sync.Mutex
+}
+
+type fakeShard struct {
+	shard   *kinesis.Shard
+	records []*kinesis.Record
+	closed  bool
+}
+
+func newFakeKinesis() *fakeKinesis {
+	return &fakeKinesis{}
+}
+
+// addShard adds an open shard without records.
+func (fk *fakeKinesis) addShard(shardId string, parents ...string) *fakeShard {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	shard := &kinesis.Shard{ShardId: aws.String(shardId)}
+	if len(parents) > 0 {
+		shard.ParentShardId = aws.String(parents[0])
+	}
+	if len(parents) > 1 {
+		shard.AdjacentParentShardId = aws.String(parents[1])
+	}
+
+	fs := &fakeShard{shard: shard}
+	fk.shards = append(fk.shards, fs)
+	return fs
+}
+
+// putRecords appends count records that arrived at arrival to the shard, numbered from base.
+func (fk *fakeKinesis) putRecords(fs *fakeShard, base int, count int, arrival time.Time) {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	for i := 0; i < count; i++ {
+		n := base + len(fs.records)
+		fs.records = append(fs.records, &kinesis.Record{
+			SequenceNumber:              aws.String(strconv.Itoa(n)),
+			PartitionKey:                aws.String(fmt.Sprintf("key-%d", n%7)),
+			Data:                        []byte(strconv.Itoa(n)),
+			ApproximateArrivalTimestamp: aws.Time(arrival),
+		})
+	}
+}
+
+func (fk *fakeKinesis) closeShard(fs *fakeShard) {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	fs.closed = true
+}
+
+// removeShard drops the shard from the stream like Kinesis does once the records of a closed shard expired.
+func (fk *fakeKinesis) removeShard(fs *fakeShard) {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	for i, shard := range fk.shards {
+		if shard == fs {
+			fk.shards = append(fk.shards[:i], fk.shards[i+1:]...)
+			return
+		}
+	}
+}
+
+// shardOf returns the shard a record was read from.
+func (fk *fakeKinesis) shardOf(sequenceNumber string) string {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	for _, fs := range fk.shards {
+		for _, record := range fs.records {
+			if aws.StringValue(record.SequenceNumber) == sequenceNumber {
+				return aws.StringValue(fs.shard.ShardId)
+			}
+		}
+	}
+	return ""
+}
+
+func (fk *fakeKinesis) find(shardId string) *fakeShard {
+	for _, fs := range fk.shards {
+		if aws.StringValue(fs.shard.ShardId) == shardId {
+			return fs
+		}
+	}
+	return nil
+}
+
+func (fk *fakeKinesis) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	out := &kinesis.ListShardsOutput{}
+	for _, fs := range fk.shards {
+		out.Shards = append(out.Shards, fs.shard)
+	}
+	return out, nil
+}
+
+func (fk *fakeKinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	fs := fk.find(aws.StringValue(input.ShardId))
+	if fs == nil {
+		return nil, fmt.Errorf("Shard %s not found", aws.StringValue(input.ShardId))
+	}
+
+	position := 0
+	switch aws.StringValue(input.ShardIteratorType) {
+	case kinesis.ShardIteratorTypeLatest:
+		position = len(fs.records)
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		position = len(fs.records)
+		for i, record := range fs.records {
+			if !record.ApproximateArrivalTimestamp.Before(aws.TimeValue(input.Timestamp)) {
+				position = i
+				break
+			}
+		}
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		sequenceNumber := aws.StringValue(input.StartingSequenceNumber)
+		for i, record := range fs.records {
+			if aws.StringValue(record.SequenceNumber) == sequenceNumber {
+				position = i
+				if aws.StringValue(input.ShardIteratorType) == kinesis.ShardIteratorTypeAfterSequenceNumber {
+					position++
+				}
+				break
+			}
+		}
+	}
+
+	return &kinesis.GetShardIteratorOutput{
+		ShardIterator: aws.String(fmt.Sprintf("%s|%d", aws.StringValue(input.ShardId), position)),
+	}, nil
+}
+
+func (fk *fakeKinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	fk.shardMu.Lock()
+	defer fk.shardMu.Unlock()
+
+	iterator := aws.StringValue(input.ShardIterator)
+	separator := strings.LastIndex(iterator, "|")
+	fs := fk.find(iterator[:separator])
+	position, _ := strconv.Atoi(iterator[separator+1:])
+
+	end := position + int(aws.Int64Value(input.Limit))
+	if end > len(fs.records) {
+		end = len(fs.records)
+	}
+
+	out := &kinesis.GetRecordsOutput{
+		Records:           fs.records[position:end],
+		NextShardIterator: aws.String(fmt.Sprintf("%s|%d", iterator[:separator], end)),
+	}
+	if fs.closed && end == len(fs.records) {
+		out.NextShardIterator = nil
+	}
+	return out, nil
+}
+
+type memLocker struct {
+	held   map[shardkey.ShardKey]*memReleaser
+	tokens map[shardkey.ShardKey]int64
+	mu     sync.Mutex
+}
+
+type memReleaser struct {
+	locker *memLocker
+	key    shardkey.ShardKey
+	token  int64
+	lost   chan struct{}
+}
+
+func newMemLocker() *memLocker {
+	return &memLocker{
+		held:   map[shardkey.ShardKey]*memReleaser{},
+		tokens: map[shardkey.ShardKey]int64{},
+	}
+}
+
+func (ml *memLocker) Lock(key shardkey.ShardKey) (locker.Releaser, bool, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.held[key] != nil {
+		return nil, false, nil
+	}
+
+	ml.tokens[key]++
+	releaser := &memReleaser{locker: ml, key: key, token: ml.tokens[key], lost: make(chan struct{})}
+	ml.held[key] = releaser
+	return releaser, true, nil
+}
+
+func (ml *memLocker) LockWait(key shardkey.ShardKey) (locker.Releaser, error) {
+	for {
+		releaser, ok, err := ml.Lock(key)
+		if err != nil || ok {
+			return releaser, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (ml *memLocker) IsLocked(key shardkey.ShardKey) (bool, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	return ml.held[key] != nil, nil
+}
+
+// expire frees the lock without its holder noticing, like a holder that was paused until its lease expired.
+func (ml *memLocker) expire(key shardkey.ShardKey) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	delete(ml.held, key)
+}
+
+// loseLock takes the lock away from its holder like an expired lease that someone else took over.
+func (ml *memLocker) loseLock(key shardkey.ShardKey) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if releaser := ml.held[key]; releaser != nil {
+		delete(ml.held, key)
+		close(releaser.lost)
+	}
+}
+
+func (mr *memReleaser) Release() error {
+	mr.locker.mu.Lock()
+	defer mr.locker.mu.Unlock()
+
+	if mr.locker.held[mr.key] == mr {
+		delete(mr.locker.held, mr.key)
+	}
+	return nil
+}
+
+func (mr *memReleaser) Lost() <-chan struct{} {
+	return mr.lost
+}
+
+func (mr *memReleaser) Token() int64 {
+	return mr.token
+}
+
+type memCheckpointer struct {
+	checkpoints map[shardkey.ShardKey]string
+	// delay slows down writes like a remote store
+	delay time.Duration
+	mu    sync.Mutex
+}
+
+func newMemCheckpointer() *memCheckpointer {
+	return &memCheckpointer{
+		checkpoints: map[shardkey.ShardKey]string{},
+	}
+}
+
+func (mc *memCheckpointer) SetCheckpoint(key shardkey.ShardKey, value string) error {
+	return mc.ForceCheckpoint(key, value)
+}
+
+func (mc *memCheckpointer) ForceCheckpoint(key shardkey.ShardKey, value string) error {
+	time.Sleep(mc.delay)
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.checkpoints[key] = value
+	return nil
+}
+
+func (mc *memCheckpointer) GetCheckpoint(key shardkey.ShardKey) (string, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	return mc.checkpoints[key], nil
+}
+
+// fencedCheckpointer rejects writes with tokens older than the greatest token it has seen.
+type fencedCheckpointer struct {
+	*memCheckpointer
+
+	tokens map[shardkey.ShardKey]int64
+}
+
+func newFencedCheckpointer() *fencedCheckpointer {
+	return &fencedCheckpointer{
+		memCheckpointer: newMemCheckpointer(),
+		tokens:          map[shardkey.ShardKey]int64{},
+	}
+}
+
+func (fc *fencedCheckpointer) SetCheckpointFenced(key shardkey.ShardKey, value string, token int64) error {
+	err := fc.Fence(key, token)
+	if err != nil {
+		return err
+	}
+	return fc.ForceCheckpoint(key, value)
+}
+
+func (fc *fencedCheckpointer) Fence(key shardkey.ShardKey, token int64) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.tokens[key] > token {
+		return checkpointer.ErrStaleToken
+	}
+	fc.tokens[key] = token
+	return nil
+}
+
+// ownAllSnitcher assigns every key to the local reader.
+type ownAllSnitcher struct{}
+
+func (ownAllSnitcher) RegisterKey(key shardkey.ShardKey)         {}
+func (ownAllSnitcher) UnregisterKey(key shardkey.ShardKey)       {}
+func (ownAllSnitcher) CheckOwnership(key shardkey.ShardKey) bool { return true }
+
+// recordingSnitcher assigns the keys that aren't owned by others to the local reader and remembers which keys are
+// registered.
+type recordingSnitcher struct {
+	registered map[shardkey.ShardKey]bool
+	others     map[shardkey.ShardKey]bool
+	mu         sync.Mutex
+}
+
+func newRecordingSnitcher(others ...shardkey.ShardKey) *recordingSnitcher {
+	rs := &recordingSnitcher{registered: map[shardkey.ShardKey]bool{}, others: map[shardkey.ShardKey]bool{}}
+	for _, key := range others {
+		rs.others[key] = true
+	}
+	return rs
+}
+
+func (rs *recordingSnitcher) RegisterKey(key shardkey.ShardKey) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.registered[key] = true
+}
+
+func (rs *recordingSnitcher) UnregisterKey(key shardkey.ShardKey) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	delete(rs.registered, key)
+}
+
+func (rs *recordingSnitcher) CheckOwnership(key shardkey.ShardKey) bool {
+	return !rs.others[key]
+}
+
+func (rs *recordingSnitcher) isRegistered(key shardkey.ShardKey) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.registered[key]
+}
+
+func newTestClient(fk *fakeKinesis) *Client {
+	return &Client{
+		kinesis:    fk,
+		distlock:   newMemLocker(),
+		checkpoint: newMemCheckpointer(),
+		snitch:     ownAllSnitcher{},
+	}
+}
@@ -1,5 +1,14 @@
 package kcl
 
+import "github.com/matijavizintin/go-kcl/shardkey"
+
+// GetStreamKey returns the legacy key of a client reading a shard.
+// Deprecated: the key is ambiguous when the client name contains a slash, use shardkey.ShardKey instead.
 func GetStreamKey(streamName, shardId, clientName string) string {
-	return streamName + "/" + shardId + "/" + clientName
+	return shardkey.New("", streamName, shardId, clientName).Legacy()
+}
+
+// shardKey returns the key of a client reading a shard in the client's namespace.
+func (c *Client) shardKey(streamName, shardId, clientName string) shardkey.ShardKey {
+	return shardkey.New(c.keyNamespace, streamName, shardId, clientName)
 }
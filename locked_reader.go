@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/matijavizintin/go-kcl/checkpointer"
 	"github.com/matijavizintin/go-kcl/locker"
 )
 
@@ -11,6 +12,10 @@ type LockedReader struct {
 	*Reader
 
 	releaser locker.Releaser
+	released chan struct{}
+	once     sync.Once
+	lost     bool
+	lostMu   sync.Mutex
 }
 
 // NewLockedReader creates a new reader with default parameters and locks it so no other instance of clientName can
@@ -26,7 +31,8 @@ func (c *Client) NewLockedReaderWithParameters(streamName string, shardId string
 		return nil, ErrMissingLocker
 	}
 
-	releaser, success, err := c.distlock.Lock(GetStreamKey(streamName, shardId, clientName))
+	key := c.shardKey(streamName, shardId, clientName)
+	releaser, success, err := c.distlock.Lock(key)
 	if err != nil {
 		return nil, err
 	}
@@ -34,18 +40,76 @@ func (c *Client) NewLockedReaderWithParameters(streamName string, shardId string
 		return nil, ErrShardLocked
 	}
 
+	// the previous holder may still be running, it must not be able to checkpoint once the shard is read again
+	if fenced, ok := c.checkpoint.(checkpointer.FencedCheckpointer); ok && releaser.Token() > 0 {
+		err = fenced.Fence(key, releaser.Token())
+		if err != nil {
+			releaser.Release()
+			return nil, err
+		}
+	}
+
 	r, err := c.NewReaderWithParameters(streamName, shardId, clientName, streamReadInterval, readBatchSize, channelBufferSize)
 	if err != nil {
+		releaser.Release()
 		return nil, err
 	}
 
+	r.token = releaser.Token()
+
 	lr := &LockedReader{
 		Reader:   r,
 		releaser: releaser,
+		released: make(chan struct{}),
 	}
+	go lr.watchLock()
+
 	return lr, nil
 }
 
+// UpdateCheckpoint sets the checkpoint to the last record that was read unless the lock was lost, in which case
+// another reader may already own the shard and ErrLockLost is returned.
+func (lr *LockedReader) UpdateCheckpoint() error {
+	if lr.IsLockLost() {
+		return ErrLockLost
+	}
+
+	return lr.Reader.UpdateCheckpoint()
+}
+
+// UpdateCheckpointTo sets the checkpoint to the given sequence number unless the lock was lost.
+func (lr *LockedReader) UpdateCheckpointTo(sequenceNumber string) error {
+	if lr.IsLockLost() {
+		return ErrLockLost
+	}
+
+	return lr.Reader.UpdateCheckpointTo(sequenceNumber)
+}
+
+// IsLockLost reports whether the lock expired or was taken by someone else while reading. The reader stops reading
+// when that happens.
+func (lr *LockedReader) IsLockLost() bool {
+	lr.lostMu.Lock()
+	defer lr.lostMu.Unlock()
+
+	return lr.lost
+}
+
+func (lr *LockedReader) watchLock() {
+	select {
+	case <-lr.releaser.Lost():
+	case <-lr.released:
+		return
+	}
+
+	lr.lostMu.Lock()
+	lr.lost = true
+	lr.lostMu.Unlock()
+
+	Logger.Printf("Lock on shard %s lost, stopping reader", lr.shardId)
+	lr.Close()
+}
+
 // Release releases the lock that was created when creating this reader. Successfully calling this function more than once
 // will result in no-op.
 func (lr *LockedReader) Release() error {
@@ -53,6 +117,9 @@ func (lr *LockedReader) Release() error {
 		return nil
 	}
 
+	lr.once.Do(func() {
+		close(lr.released)
+	})
 	return lr.releaser.Release()
 }
 
@@ -0,0 +1,93 @@
+package kcl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/checkpointer"
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+func TestLockedReaderStopsWhenLockIsLost(t *testing.T) {
+	fk := newFakeKinesis()
+	shard := fk.addShard("shard-0")
+	fk.putRecords(shard, 1000, 10, time.Now())
+
+	client := newTestClient(fk)
+	reader, err := client.NewLockedReaderWithParameters("stream", "shard-0", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+
+	records := reader.Records()
+	for i := 0; i < 10; i++ {
+		<-records
+	}
+	err = reader.UpdateCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := shardkey.New("", "stream", "shard-0", "client")
+	client.distlock.(*memLocker).loseLock(key)
+
+	// the reader stops reading and closes its channel even though the shard is open
+	fk.putRecords(shard, 1000, 10, time.Now())
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-records:
+			closed = !ok
+		case <-timeout:
+			t.Fatal("Reader kept reading after the lock was lost")
+		}
+	}
+
+	if !reader.IsLockLost() {
+		t.Error("Lost lock was not detected")
+	}
+	if err := reader.UpdateCheckpoint(); err != ErrLockLost {
+		t.Errorf("Got %v, expected %v", err, ErrLockLost)
+	}
+	if checkpoint, _ := client.checkpoint.GetCheckpoint(key); checkpoint != "1009" {
+		t.Errorf("Checkpoint moved to %s after the lock was lost, expected 1009", checkpoint)
+	}
+}
+
+func TestLockedReaderIsFencedOffByNewHolder(t *testing.T) {
+	fk := newFakeKinesis()
+	shard := fk.addShard("shard-0")
+	fk.putRecords(shard, 1000, 10, time.Now())
+
+	client := newTestClient(fk)
+	fenced := newFencedCheckpointer()
+	client.checkpoint = fenced
+	key := shardkey.New("", "stream", "shard-0", "client")
+
+	stale, err := client.NewLockedReaderWithParameters("stream", "shard-0", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Release()
+
+	err = stale.UpdateCheckpointTo("1004")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock expires while the stale reader doesn't notice and the new holder hasn't checkpointed yet
+	client.distlock.(*memLocker).expire(key)
+	holder, err := client.NewLockedReaderWithParameters("stream", "shard-0", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Release()
+
+	if err := stale.UpdateCheckpointTo("1009"); err != checkpointer.ErrStaleToken {
+		t.Errorf("Got %v, expected %v", err, checkpointer.ErrStaleToken)
+	}
+	if checkpoint, _ := fenced.GetCheckpoint(key); checkpoint != "1004" {
+		t.Errorf("Stale reader moved the checkpoint to %s, expected 1004", checkpoint)
+	}
+}
@@ -2,10 +2,12 @@ package locker
 
 import (
 	"os"
+	"sync"
 	"time"
 
 	"github.com/aerospike/aerospike-client-go"
 	"github.com/aerospike/aerospike-client-go/types"
+	"github.com/matijavizintin/go-kcl/shardkey"
 )
 
 const (
@@ -14,34 +16,153 @@ const (
 	aerospikeTTL          = 5
 	waitRetries           = 3
 	setName               = "kcl_distlock"
+
+	// lock records are kept after release so the fencing counter in them survives, the lease expires on its own
+	recordTTL = 365 * 24 * 3600
+
+	// a holder that can't refresh the lock gives it up this long before it expires so it stops before someone else can
+	// take the lock over
+	lostMargin = 2 * aerospikePingInterval
 )
 
 type AerospikeReleaser struct {
 	locker *AerospikeLocker
 
-	stop chan bool
-	key  *aerospike.Key
+	stop     chan bool
+	stopOnce sync.Once
+	lost     chan struct{}
+	lostOnce sync.Once
+	key      *aerospike.Key
+	owner    string
+	token    int64
 }
 
-func NewAerospikeReleaser(locker *AerospikeLocker, stop chan bool, key *aerospike.Key) *AerospikeReleaser {
+func NewAerospikeReleaser(locker *AerospikeLocker, key *aerospike.Key, owner string, token int64) *AerospikeReleaser {
 	return &AerospikeReleaser{
 		locker: locker,
-		stop:   stop,
+		stop:   make(chan bool),
+		lost:   make(chan struct{}),
 		key:    key,
+		owner:  owner,
+		token:  token,
 	}
 }
 
+// Release stops refreshing the lock and deletes it unless it was already lost.
 func (ar *AerospikeReleaser) Release() error {
-	ar.stop <- true
+	ar.stopOnce.Do(func() {
+		close(ar.stop)
+	})
+
+	select {
+	case <-ar.lost:
+		return nil
+	default:
+	}
 
-	_, err := ar.locker.client.Delete(nil, ar.key)
+	record, err := ar.locker.client.Get(nil, ar.key, "owner")
 	if err != nil {
 		return err
 	}
+	if record == nil || record.Bins["owner"] != ar.owner {
+		return nil
+	}
+
+	// clear only the record that was read so a lock taken over in the meantime is left alone, the record isn't deleted
+	// since it keeps the fencing counter
+	policy := aerospike.NewWritePolicy(record.Generation, recordTTL)
+	policy.GenerationPolicy = aerospike.EXPECT_GEN_EQUAL
+	policy.RecordExistsAction = aerospike.UPDATE_ONLY
+
+	err = ar.locker.client.PutBins(
+		policy,
+		ar.key,
+		aerospike.NewBin("owner", ""),
+		aerospike.NewBin("expires", 0),
+	)
+	if aserr, ok := err.(types.AerospikeError); ok && (aserr.ResultCode() == types.GENERATION_ERROR || aserr.ResultCode() == types.KEY_NOT_FOUND_ERROR) {
+		return nil
+	} else if err != nil {
+		return err
+	}
 
 	return nil
 }
 
+func (ar *AerospikeReleaser) Lost() <-chan struct{} {
+	return ar.lost
+}
+
+func (ar *AerospikeReleaser) Token() int64 {
+	return ar.token
+}
+
+func (ar *AerospikeReleaser) markLost() {
+	ar.lostOnce.Do(func() {
+		close(ar.lost)
+	})
+}
+
+// heartbeat refreshes the lock every aerospikePingInterval. The lock is lost when the record is gone or owned by
+// someone else, or when it could not be refreshed until lostMargin before its TTL runs out.
+func (ar *AerospikeReleaser) heartbeat(name string) {
+	pingTicker := time.NewTicker(aerospikePingInterval)
+	defer pingTicker.Stop()
+
+	lastRefresh := time.Now()
+	for {
+		select {
+		case <-pingTicker.C:
+		case <-ar.stop:
+			return
+		}
+
+		refreshed, err := ar.refresh()
+		if err != nil {
+			Logger.Printf("Aerospike locker %s error: %v", name, err)
+			if time.Since(lastRefresh) < aerospikeTTL*time.Second-lostMargin {
+				continue
+			}
+		}
+
+		if !refreshed {
+			Logger.Printf("Aerospike locker %s lost", name)
+			ar.markLost()
+			return
+		}
+		lastRefresh = time.Now()
+	}
+}
+
+func (ar *AerospikeReleaser) refresh() (bool, error) {
+	record, err := ar.locker.client.Get(nil, ar.key, "owner")
+	if err != nil {
+		return false, err
+	}
+	if record == nil || record.Bins["owner"] != ar.owner {
+		return false, nil
+	}
+
+	policy := aerospike.NewWritePolicy(record.Generation, recordTTL)
+	policy.GenerationPolicy = aerospike.EXPECT_GEN_EQUAL
+	policy.RecordExistsAction = aerospike.UPDATE_ONLY
+
+	now := time.Now()
+	err = ar.locker.client.PutBins(
+		policy,
+		ar.key,
+		aerospike.NewBin("updated", now.UTC().Format(time.RFC3339)),
+		aerospike.NewBin("expires", leaseExpiry(now)),
+	)
+	if aserr, ok := err.(types.AerospikeError); ok && (aserr.ResultCode() == types.GENERATION_ERROR || aserr.ResultCode() == types.KEY_NOT_FOUND_ERROR) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 type AerospikeLocker struct {
 	client    *aerospike.Client
 	namespace string
@@ -54,7 +175,7 @@ func NewAearospikeLocker(client *aerospike.Client, namespace string) *AerospikeL
 	}
 }
 
-func (al *AerospikeLocker) LockWait(name string) (Releaser, error) {
+func (al *AerospikeLocker) LockWait(name shardkey.ShardKey) (Releaser, error) {
 	var err error
 	var releaser Releaser
 	var success bool
@@ -79,58 +200,202 @@ func (al *AerospikeLocker) LockWait(name string) (Releaser, error) {
 	}
 }
 
-func (al *AerospikeLocker) Lock(name string) (Releaser, bool, error) {
+// IsLocked reports whether the lock is held. Keys without a namespace are also locked by a legacy lock, e.g. while
+// readers of an older version still run.
+func (al *AerospikeLocker) IsLocked(name shardkey.ShardKey) (bool, error) {
+	key, err := aerospike.NewKey(al.namespace, setName, name.String())
+	if err != nil {
+		return false, err
+	}
+
+	record, err := al.client.Get(nil, key, "owner", "expires")
+	if err != nil {
+		return false, err
+	}
+	if record != nil && isHeld(record.Bins) {
+		return true, nil
+	}
+
+	if name.Namespace != "" {
+		return false, nil
+	}
+
+	// legacy locks are deleted on release and expire with the record
+	legacyKey, err := aerospike.NewKey(al.namespace, setName, name.Legacy())
+	if err != nil {
+		return false, err
+	}
+	return al.client.Exists(nil, legacyKey)
+}
+
+func (al *AerospikeLocker) Lock(shardKey shardkey.ShardKey) (Releaser, bool, error) {
+	// a legacy lock is held by a reader of an older version which doesn't know about the new lock
+	if shardKey.Namespace == "" {
+		legacyKey, err := aerospike.NewKey(al.namespace, setName, shardKey.Legacy())
+		if err != nil {
+			return nil, false, err
+		}
+
+		exists, err := al.client.Exists(nil, legacyKey)
+		if err != nil {
+			return nil, false, err
+		}
+		if exists {
+			return nil, false, nil
+		}
+	}
+
+	name := shardKey.String()
 	key, err := aerospike.NewKey(al.namespace, setName, name)
 	if err != nil {
 		return nil, false, err
 	}
 
-	lockedTs := time.Now().UTC().Format(time.RFC3339)
-
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, false, err
 	}
 
-	policy := aerospike.NewWritePolicy(0, aerospikeTTL)
+	owner, err := newUUID()
+	if err != nil {
+		return nil, false, err
+	}
+
+	record, err := al.client.Get(nil, key, "owner", "expires")
+	if err != nil {
+		return nil, false, err
+	}
+
+	policy := aerospike.NewWritePolicy(0, recordTTL)
 	policy.RecordExistsAction = aerospike.CREATE_ONLY
+	if record != nil {
+		if isHeld(record.Bins) {
+			return nil, false, nil
+		}
 
-	err = al.client.PutBins(
+		// take over only the released or expired record that was read, a concurrent Lock changes its generation
+		policy = aerospike.NewWritePolicy(record.Generation, recordTTL)
+		policy.GenerationPolicy = aerospike.EXPECT_GEN_EQUAL
+		policy.RecordExistsAction = aerospike.UPDATE_ONLY
+	}
+
+	// the fencing counter is incremented in the same operation that takes the lock so the token is greater than the
+	// tokens of all previous holders
+	now := time.Now()
+	record, err = al.client.Operate(
 		policy,
 		key,
-		aerospike.NewBin("name", name),
-		aerospike.NewBin("hostname", hostname),
-		aerospike.NewBin("locked", lockedTs),
-		aerospike.NewBin("updated", time.Now().UTC().Format(time.RFC3339)),
+		aerospike.PutOp(aerospike.NewBin("name", name)),
+		aerospike.PutOp(aerospike.NewBin("owner", owner)),
+		aerospike.PutOp(aerospike.NewBin("hostname", hostname)),
+		aerospike.PutOp(aerospike.NewBin("locked", now.UTC().Format(time.RFC3339))),
+		aerospike.PutOp(aerospike.NewBin("updated", now.UTC().Format(time.RFC3339))),
+		aerospike.PutOp(aerospike.NewBin("expires", leaseExpiry(now))),
+		aerospike.AddOp(aerospike.NewBin("token", 1)),
+		aerospike.GetOpForBin("token"),
 	)
-	if err != nil {
-		if aserr, ok := err.(types.AerospikeError); ok && aserr.ResultCode() == types.KEY_EXISTS_ERROR {
+	if aserr, ok := err.(types.AerospikeError); ok {
+		switch aserr.ResultCode() {
+		case types.KEY_EXISTS_ERROR, types.GENERATION_ERROR, types.KEY_NOT_FOUND_ERROR:
 			return nil, false, nil
 		}
+	}
+	if err != nil {
 		return nil, false, err
 	}
 
-	stop := make(chan bool)
-	go func() {
-		pingTicker := time.NewTicker(aerospikePingInterval)
-		for {
-			al.client.PutBins(
-				aerospike.NewWritePolicy(0, aerospikeTTL),
-				key,
-				aerospike.NewBin("updated", time.Now().UTC().Format(time.RFC3339)),
-			)
-			if err != nil {
-				Logger.Printf("Aerospike locker %s error", name)
-			}
+	token, ok := binInt64(record.Bins["token"])
+	if !ok {
+		return nil, false, ErrInvalidToken
+	}
 
-			select {
-			case <-pingTicker.C:
-			case <-stop:
-				pingTicker.Stop()
-				return
-			}
+	releaser := NewAerospikeReleaser(al, key, owner, token)
+	go releaser.heartbeat(name)
+
+	return releaser, true, nil
+}
+
+// ListLocks scans the lock set. Legacy locks are listed without a namespace.
+func (al *AerospikeLocker) ListLocks(filter shardkey.ShardKey) ([]shardkey.ShardKey, error) {
+	recordset, err := al.client.ScanAll(aerospike.NewScanPolicy(), al.namespace, setName, "name", "owner", "expires")
+	if err != nil {
+		return nil, err
+	}
+	defer recordset.Close()
+
+	keys := []shardkey.ShardKey{}
+	seen := map[shardkey.ShardKey]bool{}
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return nil, res.Err
 		}
-	}()
 
-	return NewAerospikeReleaser(al, stop, key), true, nil
+		name, ok := res.Record.Bins["name"].(string)
+		if !ok {
+			continue
+		}
+		// legacy records have no lease, they are held until they expire
+		if _, ok := res.Record.Bins["expires"]; ok && !isHeld(res.Record.Bins) {
+			continue
+		}
+
+		key, err := shardkey.Parse(name)
+		if err != nil {
+			key, err = shardkey.ParseLegacy(name)
+		}
+		if err == nil && key.Matches(filter) && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// DeleteLock deletes the lock and its fencing counter together with the legacy lock.
+func (al *AerospikeLocker) DeleteLock(shardKey shardkey.ShardKey) error {
+	for _, name := range al.lockNames(shardKey) {
+		key, err := aerospike.NewKey(al.namespace, setName, name)
+		if err != nil {
+			return err
+		}
+
+		_, err = al.client.Delete(nil, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockNames returns the record keys a lock may be stored under.
+func (al *AerospikeLocker) lockNames(key shardkey.ShardKey) []string {
+	if key.Namespace == "" {
+		return []string{key.String(), key.Legacy()}
+	}
+	return []string{key.String()}
+}
+
+// isHeld reports whether the lock record has an owner whose lease didn't expire yet.
+func isHeld(bins aerospike.BinMap) bool {
+	owner, _ := bins["owner"].(string)
+	expires, _ := binInt64(bins["expires"])
+	return owner != "" && expires > time.Now().Unix()
+}
+
+// leaseExpiry returns the unix time the lock expires at when it's taken or refreshed at now. Hosts that share locks
+// need clocks that are in sync well within lostMargin.
+func leaseExpiry(now time.Time) int64 {
+	return now.Add(aerospikeTTL * time.Second).Unix()
+}
+
+func binInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
 }
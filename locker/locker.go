@@ -1,17 +1,42 @@
 package locker
 
 import (
+	"errors"
 	"log"
 	"os"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+var (
+	ErrLockLost     = errors.New("Lock lost")
+	ErrInvalidToken = errors.New("Invalid fencing token")
 )
 
 var Logger = log.New(os.Stderr, "", log.LstdFlags)
 
 type Releaser interface {
 	Release() error
+	// Lost returns a channel that is closed when the lock is lost, either because it could not be refreshed before it
+	// expired or because it's owned by someone else.
+	Lost() <-chan struct{}
+	// Token returns the fencing token of the lock. Every successful Lock of a name gets a token greater than the tokens
+	// of all previous holders so writes guarded by it can reject stale holders.
+	Token() int64
 }
 
 type Locker interface {
-	Lock(string) (releaser Releaser, success bool, err error)
-	LockWait(string) (releaser Releaser, err error)
+	Lock(shardkey.ShardKey) (releaser Releaser, success bool, err error)
+	LockWait(shardkey.ShardKey) (releaser Releaser, err error)
+	// IsLocked reports whether the lock is currently held by anyone.
+	IsLocked(shardkey.ShardKey) (bool, error)
+}
+
+// ListableLocker can enumerate and delete locks, e.g. to clean up after a stream is deleted.
+type ListableLocker interface {
+	Locker
+	// ListLocks returns the keys of the held locks that match filter, see shardkey.ShardKey.Matches.
+	ListLocks(filter shardkey.ShardKey) ([]shardkey.ShardKey, error)
+	// DeleteLock removes the lock regardless of its holder together with its fencing counter.
+	DeleteLock(key shardkey.ShardKey) error
 }
@@ -0,0 +1,162 @@
+package kcl
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultSampleWindow = time.Minute
+
+// ShardMetrics are the write rates of a shard, per second.
+type ShardMetrics struct {
+	ShardId         string
+	IncomingBytes   float64
+	IncomingRecords float64
+}
+
+// MetricsSource provides per-shard write rates, e.g. from CloudWatch enhanced monitoring or a TrafficSampler.
+type MetricsSource interface {
+	ShardMetrics(streamName string) ([]*ShardMetrics, error)
+}
+
+// TrafficSampler is a MetricsSource and ThroughputSource that measures the traffic put through a client. Rates are
+// computed over the last complete window, or over the current one until the first window completes.
+type TrafficSampler struct {
+	window time.Duration
+
+	previous          map[string]map[string]*ShardMetrics
+	current           map[string]map[string]*ShardMetrics
+	previousThrottled map[string]float64
+	currentThrottled  map[string]float64
+	previousStart     time.Time
+	currentStart      time.Time
+	mu                sync.Mutex
+}
+
+func NewTrafficSampler() *TrafficSampler {
+	return NewTrafficSamplerWithWindow(defaultSampleWindow)
+}
+
+func NewTrafficSamplerWithWindow(window time.Duration) *TrafficSampler {
+	return &TrafficSampler{
+		window:           window,
+		current:          map[string]map[string]*ShardMetrics{},
+		currentThrottled: map[string]float64{},
+		currentStart:     time.Now(),
+	}
+}
+
+// SetTrafficSampler makes PutRecord and PutRecords report successfully put records to the sampler.
+func (c *Client) SetTrafficSampler(sampler *TrafficSampler) {
+	c.sampler = sampler
+}
+
+// Observe records a write of a record of the given size to a shard.
+func (ts *TrafficSampler) Observe(streamName, shardId string, bytes int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.rotate()
+
+	shards, ok := ts.current[streamName]
+	if !ok {
+		shards = map[string]*ShardMetrics{}
+		ts.current[streamName] = shards
+	}
+
+	m, ok := shards[shardId]
+	if !ok {
+		m = &ShardMetrics{ShardId: shardId}
+		shards[shardId] = m
+	}
+
+	m.IncomingBytes += float64(bytes)
+	m.IncomingRecords++
+}
+
+// ObserveThrottle records a record that was rejected because the stream's write capacity was exceeded.
+func (ts *TrafficSampler) ObserveThrottle(streamName string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.rotate()
+	ts.currentThrottled[streamName]++
+}
+
+func (ts *TrafficSampler) ShardMetrics(streamName string) ([]*ShardMetrics, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.rotate()
+
+	shards := ts.current[streamName]
+	elapsed := time.Since(ts.currentStart)
+	if ts.previous != nil {
+		shards = ts.previous[streamName]
+		elapsed = ts.currentStart.Sub(ts.previousStart)
+	}
+
+	res := []*ShardMetrics{}
+	if elapsed <= 0 {
+		return res, nil
+	}
+	for _, m := range shards {
+		res = append(res, &ShardMetrics{
+			ShardId:         m.ShardId,
+			IncomingBytes:   m.IncomingBytes / elapsed.Seconds(),
+			IncomingRecords: m.IncomingRecords / elapsed.Seconds(),
+		})
+	}
+
+	return res, nil
+}
+
+// Throughput sums the shard rates and adds the rate of throttled records.
+func (ts *TrafficSampler) Throughput(streamName string) (*Throughput, error) {
+	shards, err := ts.ShardMetrics(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	throughput := &Throughput{}
+	for _, m := range shards {
+		throughput.IncomingBytes += m.IncomingBytes
+		throughput.IncomingRecords += m.IncomingRecords
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	throttled := ts.currentThrottled[streamName]
+	elapsed := time.Since(ts.currentStart)
+	if ts.previousThrottled != nil {
+		throttled = ts.previousThrottled[streamName]
+		elapsed = ts.currentStart.Sub(ts.previousStart)
+	}
+	if elapsed > 0 {
+		throughput.WriteThrottled = throttled / elapsed.Seconds()
+	}
+
+	return throughput, nil
+}
+
+func (ts *TrafficSampler) rotate() {
+	now := time.Now()
+	if now.Sub(ts.currentStart) < ts.window {
+		return
+	}
+
+	ts.previous = ts.current
+	ts.previousThrottled = ts.currentThrottled
+	ts.previousStart = ts.currentStart
+	// a window without traffic has to be reported as such
+	if now.Sub(ts.currentStart) >= 2*ts.window {
+		ts.previous = map[string]map[string]*ShardMetrics{}
+		ts.previousThrottled = map[string]float64{}
+		ts.previousStart = now.Add(-ts.window)
+	}
+
+	ts.current = map[string]map[string]*ShardMetrics{}
+	ts.currentThrottled = map[string]float64{}
+	ts.currentStart = now
+}
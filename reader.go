@@ -1,11 +1,24 @@
 package kcl
 
 import (
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/matijavizintin/go-kcl/checkpointer"
+)
+
+// Checkpoints that are not sequence numbers of processed records. They are set by the admin API to reposition readers.
+const (
+	CheckpointTrimHorizon = kinesis.ShardIteratorTypeTrimHorizon
+	CheckpointLatest      = kinesis.ShardIteratorTypeLatest
+
+	// a checkpoint with this prefix resumes at the sequence number instead of after it
+	checkpointAtPrefix = kinesis.ShardIteratorTypeAtSequenceNumber + ":"
+	// a checkpoint with this prefix resumes at the first record that arrived at or after the RFC 3339 timestamp
+	checkpointTimestampPrefix = kinesis.ShardIteratorTypeAtTimestamp + ":"
 )
 
 const defaultReadInterval = 100 * time.Microsecond
@@ -22,13 +35,17 @@ type Reader struct {
 	batchSize         *int64
 	channelBufferSize int
 
-	checkpoint     *string
-	checkpointLock sync.Mutex
-	streamReadLock sync.Mutex
-
-	err    error
-	closed bool
-	wg     *sync.WaitGroup
+	checkpoint        *string
+	checkpointArrival time.Time
+	checkpointLock    sync.Mutex
+	token             int64
+	streamReadLock    sync.Mutex
+
+	err      error
+	closed   bool
+	closedMu sync.Mutex
+	ended    bool
+	wg       *sync.WaitGroup
 }
 
 // NewReader initialize a reader on a shard with default parameters. It reads a batch of 100 records from a shard every
@@ -66,27 +83,18 @@ func (c *Client) NewReaderWithParameters(streamName string, shardId string, clie
 func (r *Reader) Records() <-chan *kinesis.Record {
 	ch := make(chan *kinesis.Record, r.channelBufferSize)
 
-	checkpoint, err := r.client.checkpoint.GetCheckpoint(GetStreamKey(r.streamName, r.shardId, r.clientName))
+	checkpoint, err := r.client.checkpoint.GetCheckpoint(r.client.shardKey(r.streamName, r.shardId, r.clientName))
 	if err != nil {
 		r.err = err
 		close(ch)
 		return ch
 	}
 
-	var shardIteratorType *string
-	if checkpoint == "" {
-		shardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
-	} else {
-		shardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
-	}
-
-	iteratorInput := &kinesis.GetShardIteratorInput{
-		StreamName:        aws.String(r.streamName),
-		ShardId:           aws.String(r.shardId),
-		ShardIteratorType: shardIteratorType,
-	}
-	if checkpoint != "" {
-		iteratorInput.StartingSequenceNumber = aws.String(checkpoint)
+	iteratorInput, err := shardIteratorInput(r.streamName, r.shardId, checkpoint)
+	if err != nil {
+		r.err = err
+		close(ch)
+		return ch
 	}
 
 	iterator, err := r.client.kinesis.GetShardIterator(iteratorInput)
@@ -96,6 +104,15 @@ func (r *Reader) Records() <-chan *kinesis.Record {
 		return ch
 	}
 
+	// a reader closed in the meantime doesn't start reading, Close must not wait while the goroutine is added
+	r.closedMu.Lock()
+	defer r.closedMu.Unlock()
+
+	if r.closed {
+		close(ch)
+		return ch
+	}
+
 	r.wg.Add(1)
 	go r.consumeStream(ch, iterator.ShardIterator)
 	return ch
@@ -112,7 +129,10 @@ func (r *Reader) UpdateCheckpoint() error {
 		return nil
 	}
 
-	err := r.client.checkpoint.SetCheckpoint(GetStreamKey(r.streamName, r.shardId, r.clientName), *r.checkpoint)
+	err := r.setCheckpoint(&checkpointer.Checkpoint{
+		SequenceNumber: *r.checkpoint,
+		ArrivalTime:    r.checkpointArrival,
+	})
 	if err != nil {
 		return err
 	}
@@ -121,6 +141,13 @@ func (r *Reader) UpdateCheckpoint() error {
 	return nil
 }
 
+// UpdateCheckpointTo sets the checkpoint to the record with the given sequence number, e.g. the last record that was
+// fully processed. It doesn't wait for the current batch, so it can be called by the consumer of the records channel
+// while the reader is blocked on it.
+func (r *Reader) UpdateCheckpointTo(sequenceNumber string) error {
+	return r.setCheckpoint(&checkpointer.Checkpoint{SequenceNumber: sequenceNumber})
+}
+
 // BlockReading stops reading from the stream after the current batch is processed. This could be used to safely
 // update checkpoints before the reader is closed.
 func (r *Reader) BlockReading() {
@@ -136,22 +163,39 @@ func (r *Reader) ResumeReading() {
 // channel. No further records will be read from the stream. After calling close and consuming the channel is safe to
 // call UpdateCheckpoint.
 func (r *Reader) Close() error {
+	r.closedMu.Lock()
 	if r.closed {
+		r.closedMu.Unlock()
 		return nil
 	}
-
 	r.closed = true
+	r.closedMu.Unlock()
+
 	r.wg.Wait()
 
 	return r.err
 }
 
 func (r *Reader) IsClosed() bool {
+	r.closedMu.Lock()
+	defer r.closedMu.Unlock()
+
 	return r.closed
 }
 
+// IsShardEnded reports whether the shard was closed by resharding and all of its records were read. The records
+// channel is closed when that happens.
+func (r *Reader) IsShardEnded() bool {
+	return r.ended
+}
+
 func (r *Reader) consumeStream(ch chan *kinesis.Record, shardIterator *string) {
-	for !r.closed {
+	defer func() {
+		close(ch)
+		r.wg.Done()
+	}()
+
+	for !r.IsClosed() {
 		r.streamReadLock.Lock()
 
 		out, err := r.client.kinesis.GetRecords(&kinesis.GetRecordsInput{
@@ -160,27 +204,104 @@ func (r *Reader) consumeStream(ch chan *kinesis.Record, shardIterator *string) {
 		})
 		if err != nil {
 			r.err = err
-			close(ch)
+			r.streamReadLock.Unlock()
 			return
 		}
 
 		shardIterator = out.NextShardIterator
 		if len(out.Records) == 0 {
 			r.streamReadLock.Unlock()
+			if shardIterator == nil {
+				r.ended = true
+				return
+			}
 			continue
 		}
 
+		// fail closed, a record that can't be decoded must not be delivered nor checkpointed past
+		err = r.decodeRecords(out.Records)
+		if err != nil {
+			r.err = err
+			r.streamReadLock.Unlock()
+			return
+		}
+
 		r.checkpointLock.Lock()
 		for _, record := range out.Records {
 			ch <- record
 			r.checkpoint = record.SequenceNumber
+			r.checkpointArrival = aws.TimeValue(record.ApproximateArrivalTimestamp)
 		}
 		r.checkpointLock.Unlock()
 		r.streamReadLock.Unlock()
 
+		// a closed shard has no next iterator once all of its records were read
+		if shardIterator == nil {
+			r.ended = true
+			return
+		}
+
 		time.Sleep(r.readInterval)
 	}
+}
 
-	close(ch)
-	r.wg.Done()
+// shardIteratorInput returns the shard iterator request that resumes reading a shard from a checkpoint.
+func shardIteratorInput(streamName, shardId, checkpoint string) (*kinesis.GetShardIteratorInput, error) {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName: aws.String(streamName),
+		ShardId:    aws.String(shardId),
+	}
+
+	switch {
+	case checkpoint == "" || checkpoint == CheckpointTrimHorizon:
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+	case checkpoint == CheckpointLatest:
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeLatest)
+	case strings.HasPrefix(checkpoint, checkpointAtPrefix):
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAtSequenceNumber)
+		input.StartingSequenceNumber = aws.String(strings.TrimPrefix(checkpoint, checkpointAtPrefix))
+	case strings.HasPrefix(checkpoint, checkpointTimestampPrefix):
+		ts, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(checkpoint, checkpointTimestampPrefix))
+		if err != nil {
+			return nil, err
+		}
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAtTimestamp)
+		input.Timestamp = aws.Time(ts)
+	default:
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(checkpoint)
+	}
+
+	return input, nil
+}
+
+// setCheckpoint guards the write with the fencing token of the reader's lock when both the lock and the checkpointer
+// support it. Checkpointers that keep metadata also get the arrival time of the record.
+func (r *Reader) setCheckpoint(checkpoint *checkpointer.Checkpoint) error {
+	key := r.client.shardKey(r.streamName, r.shardId, r.clientName)
+
+	if detailed, ok := r.client.checkpoint.(checkpointer.DetailedCheckpointer); ok {
+		checkpoint.Token = r.token
+		return detailed.SetCheckpointDetails(key, checkpoint)
+	}
+	if fenced, ok := r.client.checkpoint.(checkpointer.FencedCheckpointer); ok && r.token > 0 {
+		return fenced.SetCheckpointFenced(key, checkpoint.SequenceNumber, r.token)
+	}
+	return r.client.checkpoint.SetCheckpoint(key, checkpoint.SequenceNumber)
+}
+
+func (r *Reader) decodeRecords(records []*kinesis.Record) error {
+	if r.client.codec == nil {
+		return nil
+	}
+
+	for _, record := range records {
+		data, err := r.client.codec.Decode(record.Data)
+		if err != nil {
+			return err
+		}
+		record.Data = data
+	}
+
+	return nil
 }
@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contentType    = "application/vnd.schemaregistry.v1+json"
+	defaultTimeout = 10 * time.Second
+)
+
+// Error is returned when the registry responds with a non 2xx status code.
+type Error struct {
+	StatusCode int    `json:"-"`
+	ErrorCode  int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Schema registry error %d (%d): %s", e.ErrorCode, e.StatusCode, e.Message)
+}
+
+type schemaRequest struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+type schemaResponse struct {
+	Id         int    `json:"id"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"`
+}
+
+// HTTPRegistry is a client for the Confluent schema registry REST API. Registered and looked up schemas are cached
+// since schemas are immutable once they get an id.
+type HTTPRegistry struct {
+	baseURL  string
+	client   *http.Client
+	username string
+	password string
+
+	ids     map[string]int
+	schemas map[int]*Schema
+	cacheMu sync.RWMutex
+}
+
+func NewHTTPRegistry(baseURL string) *HTTPRegistry {
+	return NewHTTPRegistryWithClient(baseURL, &http.Client{Timeout: defaultTimeout})
+}
+
+func NewHTTPRegistryWithClient(baseURL string, client *http.Client) *HTTPRegistry {
+	return &HTTPRegistry{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  client,
+		ids:     map[string]int{},
+		schemas: map[int]*Schema{},
+	}
+}
+
+// SetBasicAuth sets the credentials that are sent with every request.
+func (hr *HTTPRegistry) SetBasicAuth(username, password string) {
+	hr.username = username
+	hr.password = password
+}
+
+func (hr *HTTPRegistry) Register(subject string, schema *Schema) (int, error) {
+	cacheKey := subject + "\x00" + schema.Type + "\x00" + schema.Definition
+
+	hr.cacheMu.RLock()
+	id, ok := hr.ids[cacheKey]
+	hr.cacheMu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	req := &schemaRequest{
+		Schema: schema.Definition,
+	}
+	// avro is the default type and older registries reject the field
+	if schema.Type != "" && schema.Type != SchemaTypeAvro {
+		req.SchemaType = schema.Type
+	}
+
+	resp := &schemaResponse{}
+	err := hr.do(http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", req, resp)
+	if err != nil {
+		return 0, err
+	}
+
+	hr.cacheMu.Lock()
+	hr.ids[cacheKey] = resp.Id
+	hr.schemas[resp.Id] = &Schema{
+		Id:         resp.Id,
+		Type:       schemaType(schema.Type),
+		Definition: schema.Definition,
+	}
+	hr.cacheMu.Unlock()
+
+	return resp.Id, nil
+}
+
+func (hr *HTTPRegistry) Lookup(id int) (*Schema, error) {
+	hr.cacheMu.RLock()
+	schema, ok := hr.schemas[id]
+	hr.cacheMu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	resp := &schemaResponse{}
+	err := hr.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, resp)
+	if regErr, ok := err.(*Error); ok && regErr.StatusCode == http.StatusNotFound {
+		return nil, ErrSchemaNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	schema = &Schema{
+		Id:         id,
+		Type:       schemaType(resp.SchemaType),
+		Definition: resp.Schema,
+	}
+
+	hr.cacheMu.Lock()
+	hr.schemas[id] = schema
+	hr.cacheMu.Unlock()
+
+	return schema, nil
+}
+
+func (hr *HTTPRegistry) do(method, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, hr.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if hr.username != "" {
+		req.SetBasicAuth(hr.username, hr.password)
+	}
+
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		regErr := &Error{}
+		// the body is not guaranteed to be json (e.g. proxies), the status code is enough in that case
+		json.NewDecoder(resp.Body).Decode(regErr)
+		regErr.StatusCode = resp.StatusCode
+		return regErr
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// schemaType returns the registry's default type when none is specified.
+func schemaType(t string) string {
+	if t == "" {
+		return SchemaTypeAvro
+	}
+	return t
+}
@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry serves the schema registry API from memory and counts the requests it handled.
+type fakeRegistry struct {
+	schemas  map[int]*schemaResponse
+	requests int
+	mu       sync.Mutex
+}
+
+func newFakeRegistry() (*fakeRegistry, *httptest.Server) {
+	fr := &fakeRegistry{schemas: map[int]*schemaResponse{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schemas/ids/", fr.lookup)
+	mux.HandleFunc("/subjects/", fr.register)
+	return fr, httptest.NewServer(mux)
+}
+
+func (fr *fakeRegistry) lookup(w http.ResponseWriter, r *http.Request) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.requests++
+
+	for id, schema := range fr.schemas {
+		if r.URL.Path == "/schemas/ids/"+strconv.Itoa(id) {
+			json.NewEncoder(w).Encode(schema)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(&Error{ErrorCode: 40403, Message: "Schema not found"})
+}
+
+func (fr *fakeRegistry) register(w http.ResponseWriter, r *http.Request) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.requests++
+
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != contentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := &schemaRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id := len(fr.schemas) + 1
+	fr.schemas[id] = &schemaResponse{Id: id, Schema: req.Schema, SchemaType: req.SchemaType}
+	json.NewEncoder(w).Encode(&schemaResponse{Id: id})
+}
+
+func (fr *fakeRegistry) requestCount() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	return fr.requests
+}
+
+func TestHTTPRegistryLookup(t *testing.T) {
+	fr, server := newFakeRegistry()
+	defer server.Close()
+	fr.schemas[7] = &schemaResponse{Id: 7, Schema: `{"type":"string"}`}
+	fr.schemas[8] = &schemaResponse{Id: 8, Schema: `syntax = "proto3";`, SchemaType: SchemaTypeProtobuf}
+
+	hr := NewHTTPRegistry(server.URL + "/")
+
+	schema, err := hr.Lookup(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Id != 7 || schema.Type != SchemaTypeAvro || schema.Definition != `{"type":"string"}` {
+		t.Errorf("Got schema %+v", schema)
+	}
+
+	schema, err = hr.Lookup(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Type != SchemaTypeProtobuf {
+		t.Errorf("Got type %s, expected %s", schema.Type, SchemaTypeProtobuf)
+	}
+
+	_, err = hr.Lookup(9)
+	if err != ErrSchemaNotFound {
+		t.Errorf("Got %v, expected %v", err, ErrSchemaNotFound)
+	}
+}
+
+func TestHTTPRegistryCachesSchemas(t *testing.T) {
+	fr, server := newFakeRegistry()
+	defer server.Close()
+	fr.schemas[7] = &schemaResponse{Id: 7, Schema: `{"type":"string"}`}
+
+	hr := NewHTTPRegistry(server.URL)
+	for i := 0; i < 3; i++ {
+		_, err := hr.Lookup(7)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests := fr.requestCount(); requests != 1 {
+		t.Errorf("Lookups made %d requests, expected 1", requests)
+	}
+
+	schema := &Schema{Definition: `{"type":"int"}`}
+	for i := 0; i < 3; i++ {
+		id, err := hr.Register("subject", schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 2 {
+			t.Errorf("Got id %d, expected 2", id)
+		}
+	}
+	// one request was made by the lookups
+	if requests := fr.requestCount(); requests != 2 {
+		t.Errorf("Made %d requests, expected 2", requests)
+	}
+
+	// a registered schema is looked up without a request
+	registered, err := hr.Lookup(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered.Definition != schema.Definition || registered.Type != SchemaTypeAvro {
+		t.Errorf("Got schema %+v", registered)
+	}
+	if requests := fr.requestCount(); requests != 2 {
+		t.Errorf("Lookup of a registered schema made a request")
+	}
+}
+
+func TestHTTPRegistryErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("<html>Unauthorized</html>"))
+			return
+		}
+
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&Error{ErrorCode: 409, Message: "Incompatible schema"})
+	}))
+	defer server.Close()
+
+	hr := NewHTTPRegistry(server.URL)
+	_, err := hr.Register("subject", &Schema{Definition: `{"type":"int"}`})
+	if regErr, ok := err.(*Error); !ok || regErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got %v, expected status %d", err, http.StatusUnauthorized)
+	}
+
+	hr.SetBasicAuth("user", "secret")
+	_, err = hr.Register("subject", &Schema{Definition: `{"type":"int"}`})
+	regErr, ok := err.(*Error)
+	if !ok || regErr.StatusCode != http.StatusConflict || regErr.ErrorCode != 409 || regErr.Message != "Incompatible schema" {
+		t.Errorf("Got %v, expected the registry's conflict", err)
+	}
+}
@@ -0,0 +1,30 @@
+package registry
+
+import (
+	"errors"
+)
+
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+	SchemaTypeJSON     = "JSON"
+)
+
+var (
+	ErrSchemaNotFound    = errors.New("Schema not found")
+	ErrInvalidWireFormat = errors.New("Invalid wire format")
+)
+
+type Schema struct {
+	Id         int
+	Type       string
+	Definition string
+}
+
+type SchemaRegistry interface {
+	// Register stores the schema under subject and returns its id. Registering a schema that is already known returns
+	// the existing id.
+	Register(subject string, schema *Schema) (int, error)
+	// Lookup returns the schema with the given id.
+	Lookup(id int) (*Schema, error)
+}
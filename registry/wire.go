@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"encoding/binary"
+)
+
+const (
+	magicByte    byte = 0
+	headerLength      = 5
+)
+
+// Encode prefixes payload with the magic byte and the big endian schema id as defined by the Confluent wire format.
+// This is the whole framing of Avro and JSON payloads, Protobuf payloads are framed with EncodeProtobuf.
+func Encode(schemaId int, payload []byte) []byte {
+	data := make([]byte, headerLength+len(payload))
+	data[0] = magicByte
+	binary.BigEndian.PutUint32(data[1:headerLength], uint32(schemaId))
+	copy(data[headerLength:], payload)
+
+	return data
+}
+
+// Decode splits data in the Confluent wire format into the schema id and the payload. The payload shares the
+// underlying array with data. The payload of a Protobuf record still starts with the message indexes, use
+// DecodeProtobuf to strip them.
+func Decode(data []byte) (int, []byte, error) {
+	if len(data) < headerLength || data[0] != magicByte {
+		return 0, nil, ErrInvalidWireFormat
+	}
+
+	return int(binary.BigEndian.Uint32(data[1:headerLength])), data[headerLength:], nil
+}
+
+// EncodeProtobuf prefixes payload with the header and the message indexes that locate the message type in the
+// Protobuf schema, e.g. [0] for the first message and [1, 0] for the first message nested in the second one. Empty
+// indexes are the same as [0] which is written as a single zero byte.
+func EncodeProtobuf(schemaId int, messageIndexes []int, payload []byte) []byte {
+	if len(messageIndexes) == 1 && messageIndexes[0] == 0 {
+		messageIndexes = nil
+	}
+
+	indexes := make([]byte, (len(messageIndexes)+1)*binary.MaxVarintLen64)
+	n := binary.PutVarint(indexes, int64(len(messageIndexes)))
+	for _, index := range messageIndexes {
+		n += binary.PutVarint(indexes[n:], int64(index))
+	}
+
+	return Encode(schemaId, append(indexes[:n], payload...))
+}
+
+// DecodeProtobuf splits data in the Confluent Protobuf wire format into the schema id, the message indexes and the
+// payload. The payload shares the underlying array with data.
+func DecodeProtobuf(data []byte) (int, []int, []byte, error) {
+	schemaId, payload, err := Decode(data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	count, n := binary.Varint(payload)
+	if n <= 0 || count < 0 || count > int64(len(payload)) {
+		return 0, nil, nil, ErrInvalidWireFormat
+	}
+	payload = payload[n:]
+
+	if count == 0 {
+		return schemaId, []int{0}, payload, nil
+	}
+
+	messageIndexes := make([]int, count)
+	for i := range messageIndexes {
+		index, n := binary.Varint(payload)
+		if n <= 0 || index < 0 {
+			return 0, nil, nil, ErrInvalidWireFormat
+		}
+		messageIndexes[i] = int(index)
+		payload = payload[n:]
+	}
+
+	return schemaId, messageIndexes, payload, nil
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeHeader(t *testing.T) {
+	data := Encode(0x01020304, []byte("payload"))
+
+	expected := append([]byte{0, 1, 2, 3, 4}, "payload"...)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Got %v, expected %v", data, expected)
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	for _, payload := range [][]byte{nil, []byte("payload")} {
+		id, decoded, err := Decode(Encode(42, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 42 || !bytes.Equal(decoded, payload) {
+			t.Errorf("Got id %d and payload %q, expected 42 and %q", id, decoded, payload)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	invalid := map[string][]byte{
+		"empty":            nil,
+		"short header":     {0, 0, 0, 1},
+		"wrong magic byte": {1, 0, 0, 0, 1, 'x'},
+	}
+
+	for name, data := range invalid {
+		_, _, err := Decode(data)
+		if err != ErrInvalidWireFormat {
+			t.Errorf("%s: got %v, expected %v", name, err, ErrInvalidWireFormat)
+		}
+	}
+}
+
+func TestEncodeProtobufFirstMessage(t *testing.T) {
+	for _, indexes := range [][]int{nil, {0}} {
+		data := EncodeProtobuf(1, indexes, []byte("payload"))
+
+		expected := append([]byte{0, 0, 0, 0, 1, 0}, "payload"...)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("Indexes %v: got %v, expected %v", indexes, data, expected)
+		}
+	}
+}
+
+func TestDecodeProtobufRoundTrip(t *testing.T) {
+	for _, indexes := range [][]int{{0}, {1}, {2, 0}, {0, 70, 3}} {
+		id, decoded, payload, err := DecodeProtobuf(EncodeProtobuf(42, indexes, []byte("payload")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 42 || !reflect.DeepEqual(decoded, indexes) || string(payload) != "payload" {
+			t.Errorf("Got id %d, indexes %v and payload %q, expected 42, %v and payload", id, decoded, payload,
+				indexes)
+		}
+	}
+}
+
+func TestDecodeProtobufInvalid(t *testing.T) {
+	invalid := map[string][]byte{
+		"missing indexes":  {0, 0, 0, 0, 1},
+		"negative count":   {0, 0, 0, 0, 1, 1},
+		"truncated index":  {0, 0, 0, 0, 1, 4, 2},
+		"wrong magic byte": {1, 0, 0, 0, 1, 0},
+	}
+
+	for name, data := range invalid {
+		_, _, _, err := DecodeProtobuf(data)
+		if err != ErrInvalidWireFormat {
+			t.Errorf("%s: got %v, expected %v", name, err, ErrInvalidWireFormat)
+		}
+	}
+}
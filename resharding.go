@@ -0,0 +1,239 @@
+package kcl
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	ReshardSplit = "SPLIT"
+	ReshardMerge = "MERGE"
+
+	// write limits of a single shard
+	shardBytesLimit   = 1024 * 1024
+	shardRecordsLimit = 1000
+)
+
+// ReshardingRules define when a shard is hot or when two adjacent shards are cold. Rates are per second.
+type ReshardingRules struct {
+	// a shard is split when either rate exceeds the threshold
+	SplitBytesThreshold   float64
+	SplitRecordsThreshold float64
+
+	// two adjacent shards are merged when both of their combined rates are below the threshold
+	MergeBytesThreshold   float64
+	MergeRecordsThreshold float64
+}
+
+var DefaultReshardingRules = ReshardingRules{
+	SplitBytesThreshold:   0.8 * shardBytesLimit,
+	SplitRecordsThreshold: 0.8 * shardRecordsLimit,
+	MergeBytesThreshold:   0.25 * shardBytesLimit,
+	MergeRecordsThreshold: 0.25 * shardRecordsLimit,
+}
+
+type ReshardRecommendation struct {
+	Action  string
+	ShardId string
+
+	// AdjacentShardId is the shard merged into ShardId
+	AdjacentShardId string
+	// NewStartingHashKey is the first hash key of the new upper shard of a split
+	NewStartingHashKey string
+
+	IncomingBytes   float64
+	IncomingRecords float64
+}
+
+// ShardAnalyzer recommends splits of hot shards and merges of cold adjacent shards based on per-shard write rates.
+type ShardAnalyzer struct {
+	client  *Client
+	metrics MetricsSource
+	rules   ReshardingRules
+}
+
+type analyzedShard struct {
+	shard     *kinesis.Shard
+	start     *big.Int
+	end       *big.Int
+	metrics   *ShardMetrics
+	resharded bool
+}
+
+func (c *Client) SplitShard(streamName, shardId, newStartingHashKey string) error {
+	_, err := c.kinesis.SplitShard(&kinesis.SplitShardInput{
+		StreamName:         aws.String(streamName),
+		ShardToSplit:       aws.String(shardId),
+		NewStartingHashKey: aws.String(newStartingHashKey),
+	})
+	return err
+}
+
+// MergeShards merges two shards with adjacent hash key ranges into a new shard.
+func (c *Client) MergeShards(streamName, shardId, adjacentShardId string) error {
+	_, err := c.kinesis.MergeShards(&kinesis.MergeShardsInput{
+		StreamName:           aws.String(streamName),
+		ShardToMerge:         aws.String(shardId),
+		AdjacentShardToMerge: aws.String(adjacentShardId),
+	})
+	return err
+}
+
+// NewShardAnalyzer creates an analyzer that reads rates from metrics. Nil rules mean DefaultReshardingRules.
+func (c *Client) NewShardAnalyzer(metrics MetricsSource, rules *ReshardingRules) *ShardAnalyzer {
+	if rules == nil {
+		rules = &DefaultReshardingRules
+	}
+
+	return &ShardAnalyzer{
+		client:  c,
+		metrics: metrics,
+		rules:   *rules,
+	}
+}
+
+// Recommend returns the splits of the open shards that are hot, splitting them in the middle of their hash key range,
+// and the merges of adjacent open shards that are cold. Shards missing from the metrics had no writes and count as
+// idle, but nothing is recommended when there are no metrics for the stream at all.
+func (sa *ShardAnalyzer) Recommend(streamName string) ([]*ReshardRecommendation, error) {
+	shards, err := sa.client.ListShards(streamName, &kinesis.ShardFilter{
+		Type: aws.String(kinesis.ShardFilterTypeAtLatest),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := sa.metrics.ShardMetrics(streamName)
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) == 0 {
+		return []*ReshardRecommendation{}, nil
+	}
+	metricsByShard := map[string]*ShardMetrics{}
+	for _, m := range metrics {
+		metricsByShard[m.ShardId] = m
+	}
+
+	analyzed := []*analyzedShard{}
+	for _, shard := range shards {
+		// closed shards are still listed until they expire
+		if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+			continue
+		}
+
+		start, ok := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.StartingHashKey), 10)
+		if !ok {
+			continue
+		}
+		end, ok := new(big.Int).SetString(aws.StringValue(shard.HashKeyRange.EndingHashKey), 10)
+		if !ok {
+			continue
+		}
+
+		m, ok := metricsByShard[aws.StringValue(shard.ShardId)]
+		if !ok {
+			m = &ShardMetrics{ShardId: aws.StringValue(shard.ShardId)}
+		}
+
+		analyzed = append(analyzed, &analyzedShard{
+			shard:   shard,
+			start:   start,
+			end:     end,
+			metrics: m,
+		})
+	}
+	sort.Slice(analyzed, func(i, j int) bool {
+		return analyzed[i].start.Cmp(analyzed[j].start) < 0
+	})
+
+	recommendations := []*ReshardRecommendation{}
+	for _, as := range analyzed {
+		if !sa.isHot(as.metrics) || as.end.Cmp(as.start) <= 0 {
+			continue
+		}
+
+		middle := new(big.Int).Add(as.start, as.end)
+		middle.Rsh(middle, 1)
+		middle.Add(middle, big.NewInt(1))
+
+		as.resharded = true
+		recommendations = append(recommendations, &ReshardRecommendation{
+			Action:             ReshardSplit,
+			ShardId:            aws.StringValue(as.shard.ShardId),
+			NewStartingHashKey: middle.String(),
+			IncomingBytes:      as.metrics.IncomingBytes,
+			IncomingRecords:    as.metrics.IncomingRecords,
+		})
+	}
+
+	for i := 0; i+1 < len(analyzed); i++ {
+		lower, upper := analyzed[i], analyzed[i+1]
+		if lower.resharded || upper.resharded {
+			continue
+		}
+		if new(big.Int).Add(lower.end, big.NewInt(1)).Cmp(upper.start) != 0 {
+			continue
+		}
+
+		bytes := lower.metrics.IncomingBytes + upper.metrics.IncomingBytes
+		records := lower.metrics.IncomingRecords + upper.metrics.IncomingRecords
+		if bytes >= sa.rules.MergeBytesThreshold || records >= sa.rules.MergeRecordsThreshold {
+			continue
+		}
+
+		lower.resharded = true
+		upper.resharded = true
+		recommendations = append(recommendations, &ReshardRecommendation{
+			Action:          ReshardMerge,
+			ShardId:         aws.StringValue(lower.shard.ShardId),
+			AdjacentShardId: aws.StringValue(upper.shard.ShardId),
+			IncomingBytes:   bytes,
+			IncomingRecords: records,
+		})
+	}
+
+	return recommendations, nil
+}
+
+// Apply performs the recommendations one after another since a stream accepts a single resharding operation at a
+// time.
+func (sa *ShardAnalyzer) Apply(streamName string, recommendations []*ReshardRecommendation) error {
+	for _, rec := range recommendations {
+		err := sa.client.WaitUntilActive(streamName)
+		if err != nil {
+			return err
+		}
+
+		switch rec.Action {
+		case ReshardSplit:
+			err = sa.client.SplitShard(streamName, rec.ShardId, rec.NewStartingHashKey)
+		case ReshardMerge:
+			err = sa.client.MergeShards(streamName, rec.ShardId, rec.AdjacentShardId)
+		}
+		if err != nil {
+			return err
+		}
+
+		Logger.Printf("Resharding %s: %s %s %s", streamName, rec.Action, rec.ShardId, rec.AdjacentShardId)
+	}
+
+	return sa.client.WaitUntilActive(streamName)
+}
+
+// Rebalance applies the current recommendations and returns them.
+func (sa *ShardAnalyzer) Rebalance(streamName string) ([]*ReshardRecommendation, error) {
+	recommendations, err := sa.Recommend(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	return recommendations, sa.Apply(streamName, recommendations)
+}
+
+func (sa *ShardAnalyzer) isHot(m *ShardMetrics) bool {
+	return m.IncomingBytes > sa.rules.SplitBytesThreshold || m.IncomingRecords > sa.rules.SplitRecordsThreshold
+}
@@ -0,0 +1,126 @@
+package kcl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// hashRangeKinesis lists shards that each cover 100 hash keys, the first one starts at 0.
+type hashRangeKinesis struct {
+	kinesisiface.KinesisAPI
+
+	shards []*kinesis.Shard
+}
+
+func (hk *hashRangeKinesis) addShard(closed bool) string {
+	i := len(hk.shards)
+	shard := &kinesis.Shard{
+		ShardId: aws.String(fmt.Sprintf("shardId-%012d", i)),
+		HashKeyRange: &kinesis.HashKeyRange{
+			StartingHashKey: aws.String(fmt.Sprint(i * 100)),
+			EndingHashKey:   aws.String(fmt.Sprint(i*100 + 99)),
+		},
+		SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+	}
+	if closed {
+		shard.SequenceNumberRange.EndingSequenceNumber = aws.String("2")
+	}
+	hk.shards = append(hk.shards, shard)
+
+	return aws.StringValue(shard.ShardId)
+}
+
+func (hk *hashRangeKinesis) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	return &kinesis.ListShardsOutput{Shards: hk.shards}, nil
+}
+
+// staticMetrics reports the same rates for every stream.
+type staticMetrics []*ShardMetrics
+
+func (sm staticMetrics) ShardMetrics(streamName string) ([]*ShardMetrics, error) {
+	return sm, nil
+}
+
+func recommend(t *testing.T, hk *hashRangeKinesis, metrics staticMetrics) []*ReshardRecommendation {
+	recommendations, err := (&Client{kinesis: hk}).NewShardAnalyzer(metrics, nil).Recommend("stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recommendations
+}
+
+func TestShardAnalyzerSplitsHotShard(t *testing.T) {
+	hk := &hashRangeKinesis{}
+	hk.addShard(false)
+	hot := hk.addShard(false)
+	hk.addShard(false)
+
+	recommendations := recommend(t, hk, staticMetrics{
+		{ShardId: "shardId-000000000000", IncomingBytes: 0.5 * shardBytesLimit},
+		{ShardId: hot, IncomingBytes: 0.9 * shardBytesLimit},
+		{ShardId: "shardId-000000000002", IncomingBytes: 0.5 * shardBytesLimit},
+	})
+
+	if len(recommendations) != 1 {
+		t.Fatalf("Got %d recommendations, expected 1", len(recommendations))
+	}
+	rec := recommendations[0]
+	if rec.Action != ReshardSplit || rec.ShardId != hot || rec.NewStartingHashKey != "150" {
+		t.Errorf("Got %s of %s at %s, expected %s of %s at 150", rec.Action, rec.ShardId, rec.NewStartingHashKey,
+			ReshardSplit, hot)
+	}
+}
+
+func TestShardAnalyzerMergesIdleAdjacentShards(t *testing.T) {
+	hk := &hashRangeKinesis{}
+	busy := hk.addShard(false)
+	lower := hk.addShard(false)
+	upper := hk.addShard(false)
+
+	// the idle shards are missing from the metrics
+	recommendations := recommend(t, hk, staticMetrics{
+		{ShardId: busy, IncomingBytes: 0.5 * shardBytesLimit},
+	})
+
+	if len(recommendations) != 1 {
+		t.Fatalf("Got %d recommendations, expected 1", len(recommendations))
+	}
+	rec := recommendations[0]
+	if rec.Action != ReshardMerge || rec.ShardId != lower || rec.AdjacentShardId != upper {
+		t.Errorf("Got %s of %s and %s, expected %s of %s and %s", rec.Action, rec.ShardId, rec.AdjacentShardId,
+			ReshardMerge, lower, upper)
+	}
+}
+
+func TestShardAnalyzerDoesNotMergeNonAdjacentShards(t *testing.T) {
+	hk := &hashRangeKinesis{}
+	first := hk.addShard(false)
+	hk.addShard(true)
+	hk.addShard(false)
+	busy := hk.addShard(false)
+	hk.addShard(false)
+
+	// the second shard is closed so the first one has no open neighbour, the busy shard separates the other two
+	recommendations := recommend(t, hk, staticMetrics{
+		{ShardId: first, IncomingBytes: 1},
+		{ShardId: busy, IncomingBytes: 0.5 * shardBytesLimit},
+	})
+
+	if len(recommendations) != 0 {
+		t.Errorf("Got %d recommendations, expected none", len(recommendations))
+	}
+}
+
+func TestShardAnalyzerWithoutMetrics(t *testing.T) {
+	hk := &hashRangeKinesis{}
+	hk.addShard(false)
+	hk.addShard(false)
+
+	if recommendations := recommend(t, hk, staticMetrics{}); len(recommendations) != 0 {
+		t.Errorf("Got %d recommendations without metrics, expected none", len(recommendations))
+	}
+}
@@ -0,0 +1,77 @@
+package kcl
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/matijavizintin/go-kcl/registry"
+)
+
+// PutSchemaRecord registers the schema under subject (ids are cached so this is a round-trip only the first time) and
+// puts the payload prefixed with the schema id into the stream. Protobuf payloads are framed as the first message of
+// the schema, records of other message types are framed with registry.EncodeProtobuf and put with PutRecord.
+func (c *Client) PutSchemaRecord(streamName, partitionKey, subject string, schema *registry.Schema, payload []byte) error {
+	data, err := c.encodeSchemaPayload(subject, schema, payload)
+	if err != nil {
+		return err
+	}
+
+	return c.PutRecord(streamName, partitionKey, data)
+}
+
+// NewSchemaRecordsEntry prepares an entry for PutRecords with the payload prefixed with the id of the schema
+// registered under subject.
+func (c *Client) NewSchemaRecordsEntry(partitionKey, subject string, schema *registry.Schema, payload []byte) (*kinesis.PutRecordsRequestEntry, error) {
+	data, err := c.encodeSchemaPayload(subject, schema, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kinesis.PutRecordsRequestEntry{
+		Data:         data,
+		PartitionKey: aws.String(partitionKey),
+	}, nil
+}
+
+// DecodeSchemaRecord resolves the writer schema of a record produced with PutSchemaRecord and returns it together with
+// the payload stripped of the schema id prefix. The message indexes of Protobuf records are stripped as well, use
+// registry.DecodeProtobuf when they are needed to pick the message type.
+func (c *Client) DecodeSchemaRecord(record *kinesis.Record) (*registry.Schema, []byte, error) {
+	if c.schemas == nil {
+		return nil, nil, ErrMissingSchemaRegistry
+	}
+
+	schemaId, payload, err := registry.Decode(record.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	schema, err := c.schemas.Lookup(schemaId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if schema.Type == registry.SchemaTypeProtobuf {
+		_, _, payload, err = registry.DecodeProtobuf(record.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return schema, payload, nil
+}
+
+func (c *Client) encodeSchemaPayload(subject string, schema *registry.Schema, payload []byte) ([]byte, error) {
+	if c.schemas == nil {
+		return nil, ErrMissingSchemaRegistry
+	}
+
+	schemaId, err := c.schemas.Register(subject, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if schema.Type == registry.SchemaTypeProtobuf {
+		return registry.EncodeProtobuf(schemaId, nil, payload), nil
+	}
+	return registry.Encode(schemaId, payload), nil
+}
@@ -0,0 +1,88 @@
+package shardkey
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// version prefixes the encoding so encoded keys can't be confused with legacy slash-joined keys
+const version = "v1:"
+
+var ErrInvalidKey = errors.New("Invalid shard key")
+
+// ShardKey identifies the state of a client reading a shard of a stream. It's used by lockers, checkpointers and
+// snitchers instead of slash-joined strings. Namespace separates the state of multiple tenants sharing a backend.
+type ShardKey struct {
+	Namespace  string
+	StreamName string
+	ShardId    string
+	ClientName string
+}
+
+func New(namespace, streamName, shardId, clientName string) ShardKey {
+	return ShardKey{
+		Namespace:  namespace,
+		StreamName: streamName,
+		ShardId:    shardId,
+		ClientName: clientName,
+	}
+}
+
+// String returns the stable encoding of the key. Every component is escaped so any character, including the
+// separator, can be used in names.
+func (k ShardKey) String() string {
+	return version + strings.Join([]string{
+		url.PathEscape(k.Namespace),
+		url.PathEscape(k.StreamName),
+		url.PathEscape(k.ShardId),
+		url.PathEscape(k.ClientName),
+	}, "/")
+}
+
+// Legacy returns the key in the format used before keys were structured. It ignores the namespace.
+func (k ShardKey) Legacy() string {
+	return k.StreamName + "/" + k.ShardId + "/" + k.ClientName
+}
+
+// Matches reports whether the non-empty components of filter are equal to the components of the key. The namespace
+// is always compared so a filter never matches keys of other tenants.
+func (k ShardKey) Matches(filter ShardKey) bool {
+	return k.Namespace == filter.Namespace &&
+		(filter.StreamName == "" || k.StreamName == filter.StreamName) &&
+		(filter.ShardId == "" || k.ShardId == filter.ShardId) &&
+		(filter.ClientName == "" || k.ClientName == filter.ClientName)
+}
+
+// Parse decodes a key encoded by String.
+func Parse(s string) (ShardKey, error) {
+	if !strings.HasPrefix(s, version) {
+		return ShardKey{}, ErrInvalidKey
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, version), "/")
+	if len(parts) != 4 {
+		return ShardKey{}, ErrInvalidKey
+	}
+
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return ShardKey{}, ErrInvalidKey
+		}
+		parts[i] = unescaped
+	}
+
+	return New(parts[0], parts[1], parts[2], parts[3]), nil
+}
+
+// ParseLegacy decodes a key in the legacy format. Stream names and shard ids never contain a slash so the rest of
+// the key is the client name.
+func ParseLegacy(s string) (ShardKey, error) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 {
+		return ShardKey{}, ErrInvalidKey
+	}
+
+	return New("", parts[0], parts[1], parts[2]), nil
+}
@@ -0,0 +1,91 @@
+package shardkey
+
+import (
+	"testing"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	keys := []ShardKey{
+		New("", "stream", "shardId-000000000000", "client"),
+		New("tenant", "stream", "shardId-000000000000", "client"),
+		New("", "stream", "shardId-000000000000", "team/client"),
+		New("a/b", "stream", "shardId-000000000000", "100%/client%2F"),
+		New("", "", "", ""),
+		New("v1:", "stream", "shard", "client name?#"),
+	}
+
+	for _, key := range keys {
+		parsed, err := Parse(key.String())
+		if err != nil {
+			t.Errorf("Parsing %s failed. Err: %v", key.String(), err)
+			continue
+		}
+		if parsed != key {
+			t.Errorf("Got %+v, expected %+v", parsed, key)
+		}
+	}
+}
+
+func TestStringEscapesSeparator(t *testing.T) {
+	encoded := New("", "stream", "shard", "team/client").String()
+
+	if encoded != "v1:/stream/shard/team%2Fclient" {
+		t.Errorf("Got %s, expected v1:/stream/shard/team%%2Fclient", encoded)
+	}
+}
+
+func TestNamespaceSeparatesKeys(t *testing.T) {
+	key := New("", "stream", "shard", "client")
+	tenant := New("tenant", "stream", "shard", "client")
+
+	if key.String() == tenant.String() {
+		t.Errorf("Keys of different namespaces are both encoded as %s", key.String())
+	}
+	if key.Legacy() != tenant.Legacy() {
+		t.Errorf("Legacy keys %s and %s differ, the namespace should be ignored", key.Legacy(), tenant.Legacy())
+	}
+
+	if tenant.Matches(New("", "stream", "", "")) {
+		t.Error("Key of a tenant matches a filter without a namespace")
+	}
+	if !tenant.Matches(New("tenant", "stream", "", "")) {
+		t.Error("Key doesn't match a filter of its namespace")
+	}
+	if tenant.Matches(New("tenant", "other", "", "")) {
+		t.Error("Key matches a filter of another stream")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"stream/shard/client",
+		"v1:stream/shard/client",
+		"v1:/stream/shard/client/extra",
+		"v1:/stream/shard/%zz",
+	}
+
+	for _, s := range invalid {
+		if _, err := Parse(s); err != ErrInvalidKey {
+			t.Errorf("Parsing %q: got %v, expected %v", s, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	key := New("", "stream", "shardId-000000000000", "team/client")
+
+	parsed, err := ParseLegacy(key.Legacy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != key {
+		t.Errorf("Got %+v, expected %+v", parsed, key)
+	}
+
+	for _, s := range []string{"", "stream", "stream/shard"} {
+		if _, err := ParseLegacy(s); err != ErrInvalidKey {
+			t.Errorf("Parsing %q: got %v, expected %v", s, err, ErrInvalidKey)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package kcl
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/snitcher"
+)
+
+// Drain gives up all shards of the reader so other readers take them over right away instead of after the snitcher's
+// claims expire. The snitcher gives up its claims if it's a snitcher.Drainer, then every shard is handed off: the
+// records that were already read are pushed to the records channel or handled by the workers, checkpointed and the
+// locks are released. The reader is closed afterwards. Drain returns ctx's error when the handoffs didn't complete in
+// time, locks that weren't released expire on their own. The records channel has to be consumed until it's closed.
+func (sr *SharedReader) Drain(ctx context.Context) error {
+	if drainer, ok := sr.client.snitch.(snitcher.Drainer); ok {
+		if err := drainer.Drain(ctx); err != nil {
+			Logger.Printf("Drain of snitcher failed: %v", err)
+		}
+	}
+
+	if !sr.markClosed() {
+		return sr.firstErr()
+	}
+
+	// no consumer is added once the reader is closed
+	sr.consumersMu.Lock()
+	consumers := append([]*shardConsumer{}, sr.consumers...)
+	sr.consumersMu.Unlock()
+
+	for _, sc := range consumers {
+		sr.startHandoff(sc)
+	}
+	go sr.stopConsumers()
+
+	for _, sc := range consumers {
+		select {
+		case <-sc.stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	Logger.Printf("Drained %d shards", len(consumers))
+	return sr.firstErr()
+}
+
+// DrainOnSignal drains the reader within timeout when the process receives one of signals, SIGTERM if none are given.
+// The signals don't terminate the process anymore, it should exit once the records channel is closed or Process
+// returns.
+func (sr *SharedReader) DrainOnSignal(timeout time.Duration, signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	go func() {
+		sig := <-ch
+		signal.Stop(ch)
+		Logger.Printf("Received %v, draining", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := sr.Drain(ctx); err != nil {
+			Logger.Printf("Drain failed: %v", err)
+		}
+	}()
+}
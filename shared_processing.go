@@ -0,0 +1,263 @@
+package kcl
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const defaultProcessCheckpointInterval = time.Second * 10
+
+var ErrInvalidWorkerCount = errors.New("Invalid worker count")
+
+// Partitioning decides which worker of SharedReader.Process handles a record. Records of the same partition are
+// handled by the same worker in the order they were read.
+type Partitioning int
+
+const (
+	// PartitionByShard handles all records of a shard in order.
+	PartitionByShard Partitioning = iota
+	// PartitionByKey handles the records of a partition key in order, records of a shard are spread over workers.
+	PartitionByKey
+)
+
+// RecordHandler handles a record read from a shard. A returned error stops the reader, the record and all records
+// after it are not checkpointed.
+type RecordHandler func(record *Record) error
+
+type workItem struct {
+	sc     *shardConsumer
+	record *Record
+	entry  *pendingRecord
+}
+
+// shardProgress tracks the records of a shard that were dispatched to workers. Records complete out of order when
+// they are partitioned by key, so only the prefix of completed records can be checkpointed.
+type shardProgress struct {
+	pending   []*pendingRecord
+	completed string
+	idle      chan struct{}
+	mu        sync.Mutex
+
+	checkpointed string
+	checkpointMu sync.Mutex
+}
+
+type pendingRecord struct {
+	sequenceNumber string
+	done           bool
+}
+
+func newShardProgress() *shardProgress {
+	idle := make(chan struct{})
+	close(idle)
+
+	return &shardProgress{
+		idle: idle,
+	}
+}
+
+func (sp *shardProgress) add(sequenceNumber string) *pendingRecord {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if len(sp.pending) == 0 {
+		sp.idle = make(chan struct{})
+	}
+
+	entry := &pendingRecord{sequenceNumber: sequenceNumber}
+	sp.pending = append(sp.pending, entry)
+	return entry
+}
+
+func (sp *shardProgress) complete(entry *pendingRecord) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	entry.done = true
+
+	i := 0
+	for ; i < len(sp.pending) && sp.pending[i].done; i++ {
+		sp.completed = sp.pending[i].sequenceNumber
+	}
+	sp.pending = sp.pending[i:]
+
+	if i > 0 && len(sp.pending) == 0 {
+		close(sp.idle)
+	}
+}
+
+// updateCheckpoint checkpoints the last record that was completed together with all records before it unless it was
+// already checkpointed.
+func (sp *shardProgress) updateCheckpoint(lockedReader *LockedReader) error {
+	sp.checkpointMu.Lock()
+	defer sp.checkpointMu.Unlock()
+
+	sp.mu.Lock()
+	completed := sp.completed
+	sp.mu.Unlock()
+
+	if completed == "" || completed == sp.checkpointed {
+		return nil
+	}
+
+	err := lockedReader.UpdateCheckpointTo(completed)
+	if err != nil {
+		return err
+	}
+
+	sp.checkpointed = completed
+	return nil
+}
+
+// idleChan returns a channel that is closed when no dispatched record is pending.
+func (sp *shardProgress) idleChan() <-chan struct{} {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return sp.idle
+}
+
+// Process reads the shards like Records but delivers the records to workers goroutines that call handler. Records are
+// partitioned over workers by shard or by partition key and handled in order within a partition, so slow records only
+// hold up their own partition. Checkpoints are set to the completed records periodically, when a shard is handed off
+// and when the reader is closed. Process blocks until the reader is closed and returns its error. It can't be used
+// together with Records.
+func (sr *SharedReader) Process(workers int, partitioning Partitioning, handler RecordHandler) error {
+	if workers < 1 {
+		return ErrInvalidWorkerCount
+	}
+
+	sr.partitioning = partitioning
+	sr.workers = make([]chan *workItem, workers)
+	sr.failed = make(chan struct{})
+
+	workersWg := &sync.WaitGroup{}
+	for i := range sr.workers {
+		sr.workers[i] = make(chan *workItem, sr.channelBufferSize)
+
+		workersWg.Add(1)
+		go sr.processWork(sr.workers[i], handler, workersWg)
+	}
+
+	stopCheckpoints := make(chan struct{})
+	checkpointsDone := make(chan struct{})
+	go sr.checkpointProcessed(stopCheckpoints, checkpointsDone)
+
+	go sr.consumeRecords()
+
+	// the channel is closed when the reader is closed and all shard consumers stopped
+	for range sr.recordsChan {
+	}
+
+	for _, ch := range sr.workers {
+		close(ch)
+	}
+	workersWg.Wait()
+
+	close(stopCheckpoints)
+	<-checkpointsDone
+
+	err := sr.UpdateCheckpoint()
+	if readErr := sr.firstErr(); readErr != nil {
+		return readErr
+	}
+	return err
+}
+
+func (sr *SharedReader) processWork(ch chan *workItem, handler RecordHandler, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	failed := false
+	for item := range ch {
+		// after a failure the remaining records are drained without handling them so shard consumers can stop
+		if failed {
+			continue
+		}
+
+		err := handler(item.record)
+		if err != nil {
+			failed = true
+			sr.fail(err)
+			continue
+		}
+		item.sc.progress.complete(item.entry)
+	}
+}
+
+func (sr *SharedReader) checkpointProcessed(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(sr.checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		err := sr.UpdateCheckpoint()
+		if err != nil {
+			Logger.Printf("Checkpoint of processed records failed: %v", err)
+		}
+	}
+}
+
+// SetCheckpointInterval sets how often Process checkpoints the completed records.
+func (sr *SharedReader) SetCheckpointInterval(interval time.Duration) {
+	sr.checkpointInterval = interval
+}
+
+// dispatch delivers a record to the records channel or, when processing, to the worker of its partition.
+func (sr *SharedReader) dispatch(sc *shardConsumer, record *kinesis.Record) {
+	if sr.workers == nil {
+		if sr.taggedChan != nil {
+			sr.taggedChan <- &Record{Record: record, StreamName: sc.streamName, ShardId: sc.shardId}
+		} else {
+			sr.recordsChan <- record
+		}
+		return
+	}
+
+	entry := sc.progress.add(aws.StringValue(record.SequenceNumber))
+
+	partition := sc.streamName + "/" + sc.shardId
+	if sr.partitioning == PartitionByKey {
+		partition = aws.StringValue(record.PartitionKey)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(partition))
+
+	sr.workers[h.Sum32()%uint32(len(sr.workers))] <- &workItem{
+		sc:     sc,
+		record: &Record{Record: record, StreamName: sc.streamName, ShardId: sc.shardId},
+		entry:  entry,
+	}
+}
+
+// waitProcessed waits until the dispatched records of the shard were handled or processing failed.
+func (sr *SharedReader) waitProcessed(sc *shardConsumer) {
+	if sr.workers == nil {
+		return
+	}
+
+	select {
+	case <-sc.progress.idleChan():
+	case <-sr.failed:
+	}
+}
+
+func (sr *SharedReader) fail(err error) {
+	sr.failOnce.Do(func() {
+		sr.setErr(err)
+		close(sr.failed)
+		sr.Close()
+	})
+}
@@ -0,0 +1,182 @@
+package kcl
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+func newProcessingReader(t *testing.T, fk *fakeKinesis) (*Client, *SharedReader) {
+	client := newTestClient(fk)
+	reader, err := client.NewSharedReaderWithParameters("stream", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.SetCheckpointInterval(5 * time.Millisecond)
+
+	return client, reader
+}
+
+func sequenceNumber(record *Record) int {
+	n, _ := strconv.Atoi(aws.StringValue(record.SequenceNumber))
+	return n
+}
+
+func TestProcessKeepsOrderOfPartitionKeys(t *testing.T) {
+	fk := newFakeKinesis()
+	fk.putRecords(fk.addShard("shard-0"), 1000, 100, time.Now())
+	fk.putRecords(fk.addShard("shard-1"), 2000, 100, time.Now())
+	client, reader := newProcessingReader(t, fk)
+
+	last := map[string]int{}
+	processed := 0
+	mu := &sync.Mutex{}
+	err := reader.Process(4, PartitionByKey, func(record *Record) error {
+		// slow keys must not hold up the others
+		n := sequenceNumber(record)
+		if n%3 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := record.ShardId + "/" + aws.StringValue(record.PartitionKey)
+		if n <= last[key] {
+			t.Errorf("Record %d of %s was handled after %d", n, key, last[key])
+		}
+		last[key] = n
+
+		processed++
+		if processed == 200 {
+			go reader.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for shardId, expected := range map[string]string{"shard-0": "1099", "shard-1": "2099"} {
+		checkpoint, _ := client.checkpoint.GetCheckpoint(shardkey.New("", "stream", shardId, "client"))
+		if checkpoint != expected {
+			t.Errorf("Checkpoint of %s is %q, expected %s", shardId, checkpoint, expected)
+		}
+	}
+}
+
+func TestProcessCheckpointsOnlyCompletedPrefix(t *testing.T) {
+	fk := newFakeKinesis()
+	fk.putRecords(fk.addShard("shard-0"), 1000, 20, time.Now())
+	client, reader := newProcessingReader(t, fk)
+	key := shardkey.New("", "stream", "shard-0", "client")
+
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- reader.Process(4, PartitionByKey, func(record *Record) error {
+			if sequenceNumber(record) == 1005 {
+				<-release
+			}
+			return nil
+		})
+	}()
+
+	checkpoint := func() string {
+		checkpoint, _ := client.checkpoint.GetCheckpoint(key)
+		return checkpoint
+	}
+
+	// records after the slow one complete on other workers but the checkpoint stays before it
+	waitFor(t, func() bool {
+		return checkpoint() == "1004"
+	})
+	time.Sleep(50 * time.Millisecond)
+	if current := checkpoint(); current != "1004" {
+		t.Errorf("Checkpoint moved to %s while record 1005 was handled", current)
+	}
+
+	close(release)
+	waitFor(t, func() bool {
+		return checkpoint() == "1019"
+	})
+
+	reader.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProcessStopsOnHandlerError(t *testing.T) {
+	fk := newFakeKinesis()
+	fk.putRecords(fk.addShard("shard-0"), 1000, 100, time.Now())
+	client, reader := newProcessingReader(t, fk)
+	key := shardkey.New("", "stream", "shard-0", "client")
+
+	errHandler := errors.New("Handler failed")
+	done := make(chan error)
+	go func() {
+		done <- reader.Process(3, PartitionByKey, func(record *Record) error {
+			if sequenceNumber(record) == 1005 {
+				return errHandler
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != errHandler {
+			t.Errorf("Got %v, expected %v", err, errHandler)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reader didn't stop after the handler failed")
+	}
+
+	checkpoint, _ := client.checkpoint.GetCheckpoint(key)
+	if n, _ := strconv.Atoi(checkpoint); n >= 1005 {
+		t.Errorf("Checkpoint is %s, expected it before the failed record 1005", checkpoint)
+	}
+	if locked, _ := client.distlock.IsLocked(key); locked {
+		t.Error("Shard is still locked after the reader stopped")
+	}
+}
+
+func TestShardProgressCompletesInOrder(t *testing.T) {
+	sp := newShardProgress()
+	first := sp.add("1")
+	second := sp.add("2")
+	third := sp.add("3")
+
+	sp.complete(third)
+	if sp.completed != "" {
+		t.Errorf("Completed %q before the first record, expected none", sp.completed)
+	}
+
+	sp.complete(first)
+	if sp.completed != "1" {
+		t.Errorf("Completed %q, expected 1", sp.completed)
+	}
+
+	select {
+	case <-sp.idleChan():
+		t.Error("Progress is idle while a record is pending")
+	default:
+	}
+
+	sp.complete(second)
+	if sp.completed != "3" {
+		t.Errorf("Completed %q, expected 3", sp.completed)
+	}
+
+	select {
+	case <-sp.idleChan():
+	default:
+		t.Error("Progress isn't idle after all records completed")
+	}
+}
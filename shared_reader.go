@@ -5,35 +5,84 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/matijavizintin/go-kcl/shardkey"
+	"github.com/matijavizintin/go-kcl/snitcher"
 )
 
 var (
 	streamConsumerUpdate = time.Second * 2
+	handoffPollInterval  = time.Millisecond * 500
+)
+
+const defaultHandoffTimeout = time.Second * 30
+
+// states of a shard consumer
+const (
+	consumerAcquiring = iota
+	consumerRunning
+	consumerHandingOff
+	consumerStopped
 )
 
 type SharedReader struct {
 	client *Client
 
-	streamName         string
+	streams            StreamSelector
 	clientName         string
 	streamReadInterval time.Duration
 	readBatchSize      int
 	channelBufferSize  int
+	handoffTimeout     time.Duration
+
+	onShardAcquired ShardHook
+	onShardReleased ShardHook
+	onShardEnded    ShardHook
+
+	// set by Process
+	partitioning       Partitioning
+	workers            []chan *workItem
+	checkpointInterval time.Duration
+	failed             chan struct{}
+	failOnce           sync.Once
 
-	err error
+	// err is the first error that stopped the reader
+	err   error
+	errMu sync.Mutex
 
 	recordsChan chan *kinesis.Record
+	taggedChan  chan *Record
 	closed      bool
 	closedMu    sync.Mutex
 
-	consumers   []*LockedReader
+	consumers   []*shardConsumer
 	consumersMu sync.Mutex
 	consumerWg  *sync.WaitGroup
 }
 
+// ShardEvent describes a shard whose ownership changed. Checkpoint is the checkpoint of the shard at the time of the
+// event, empty if there is none.
+type ShardEvent struct {
+	StreamName string
+	ShardId    string
+	ClientName string
+	Checkpoint string
+}
+
+// ShardHook is called when a SharedReader acquires, releases or finishes a shard. Hooks are called from the goroutine
+// reading the shard, no records of the shard are read while a hook runs.
+type ShardHook func(event *ShardEvent)
+
 type shardConsumer struct {
+	key          shardkey.ShardKey
+	streamName   string
+	shardId      string
 	lockedReader *LockedReader
-	running      bool
+	state        int
+	// done is closed when all records of the reader were pushed to the records channel
+	done chan struct{}
+	// stopped is closed when the consumer is stopped
+	stopped  chan struct{}
+	progress *shardProgress
 }
 
 func (c *Client) NewSharedReader(streamName string, clientName string) (*SharedReader, error) {
@@ -41,6 +90,16 @@ func (c *Client) NewSharedReader(streamName string, clientName string) (*SharedR
 }
 
 func (c *Client) NewSharedReaderWithParameters(streamName string, clientName string, streamReadInterval time.Duration, readBatchSize int, channelBufferSize int) (*SharedReader, error) {
+	return c.NewMultiStreamReaderWithParameters(StaticStreams(streamName), clientName, streamReadInterval, readBatchSize, channelBufferSize)
+}
+
+// NewMultiStreamReader creates a shared reader that consumes all streams selected by streams, e.g. StaticStreams or
+// StreamsMatching. The shards of all streams are balanced over the readers of clientName together.
+func (c *Client) NewMultiStreamReader(streams StreamSelector, clientName string) (*SharedReader, error) {
+	return c.NewMultiStreamReaderWithParameters(streams, clientName, defaultReadInterval, defaultBatchSize, defaultChannelSize)
+}
+
+func (c *Client) NewMultiStreamReaderWithParameters(streams StreamSelector, clientName string, streamReadInterval time.Duration, readBatchSize int, channelBufferSize int) (*SharedReader, error) {
 	if c.distlock == nil {
 		return nil, ErrMissingLocker
 	}
@@ -53,15 +112,17 @@ func (c *Client) NewSharedReaderWithParameters(streamName string, clientName str
 
 	r := &SharedReader{
 		client:             c,
-		streamName:         streamName,
+		streams:            streams,
 		clientName:         clientName,
 		streamReadInterval: streamReadInterval,
 		readBatchSize:      readBatchSize,
 		channelBufferSize:  channelBufferSize,
+		handoffTimeout:     defaultHandoffTimeout,
+		checkpointInterval: defaultProcessCheckpointInterval,
 
 		recordsChan: make(chan *kinesis.Record),
 
-		consumers:  []*LockedReader{},
+		consumers:  []*shardConsumer{},
 		consumerWg: &sync.WaitGroup{},
 	}
 
@@ -73,94 +134,403 @@ func (sr *SharedReader) Records() chan *kinesis.Record {
 	return sr.recordsChan
 }
 
+// TaggedRecords consumes the streams like Records but delivers every record with the stream and shard it was read
+// from. It can't be used together with Records.
+func (sr *SharedReader) TaggedRecords() <-chan *Record {
+	sr.taggedChan = make(chan *Record)
+
+	go sr.consumeRecords()
+	return sr.taggedChan
+}
+
+// SetHandoffTimeout sets how long a reader that won a shard waits for the previous owner to hand it off before it
+// tries again on the next update.
+func (sr *SharedReader) SetHandoffTimeout(timeout time.Duration) {
+	sr.handoffTimeout = timeout
+}
+
+// OnShardAcquired sets a hook that is called when the reader locked a shard, before its first record is read.
+func (sr *SharedReader) OnShardAcquired(hook ShardHook) {
+	sr.onShardAcquired = hook
+}
+
+// OnShardReleased sets a hook that is called after a shard was handed off to another reader, its lock was lost or the
+// reader was closed.
+func (sr *SharedReader) OnShardReleased(hook ShardHook) {
+	sr.onShardReleased = hook
+}
+
+// OnShardEnded sets a hook that is called when all records of a shard closed by resharding were read.
+func (sr *SharedReader) OnShardEnded(hook ShardHook) {
+	sr.onShardEnded = hook
+}
+
 func (sr *SharedReader) consumeShard(sc *shardConsumer) {
-	sr.consumerWg.Add(1)
-	defer sr.consumerWg.Done()
+	defer close(sc.done)
+
+	Logger.Printf("Consuming shard: %s", sc.shardId)
 
-	Logger.Printf("Consuming shard: %s", sc.lockedReader.shardId)
+	// snitchers that balance by load measure it from the records read
+	observer, _ := sr.client.snitch.(snitcher.LoadObserver)
 
 	for record := range sc.lockedReader.Records() {
-		sr.recordsChan <- record
+		if observer != nil {
+			observer.Observe(sc.key, len(record.Data))
+		}
+		sr.dispatch(sc, record)
 	}
 	if err := sc.lockedReader.Close(); err != nil {
-		sr.err = err
+		sr.setErr(err)
 		sr.Close()
 	}
-	sc.running = false
 
-	Logger.Printf("Stopped consuming shard: %s", sc.lockedReader.shardId)
+	// a shard that is handed off is finished by the handoff, otherwise it stopped because it ended, its lock was lost,
+	// reading failed or the reader was closed
+	if sr.setConsumerState(sc, consumerRunning, consumerHandingOff) {
+		sr.finishConsumer(sc)
+	}
+
+	Logger.Printf("Stopped consuming shard: %s", sc.shardId)
+}
+
+// shardSet is the state of the shards known to consumeRecords.
+type shardSet struct {
+	consumers map[shardkey.ShardKey]*shardConsumer
+	// registered keys are competed for with the snitcher
+	registered map[shardkey.ShardKey]bool
+	// retired keys belong to shards that ended, they stay until the shard disappears from the stream
+	retired map[shardkey.ShardKey]bool
 }
 
 func (sr *SharedReader) consumeRecords() {
-	runningConsumers := map[string]*shardConsumer{}
+	shards := &shardSet{
+		consumers:  map[shardkey.ShardKey]*shardConsumer{},
+		registered: map[shardkey.ShardKey]bool{},
+		retired:    map[shardkey.ShardKey]bool{},
+	}
 
 	for range time.Tick(streamConsumerUpdate) {
-		if sr.closed {
+		if sr.isClosed() {
 			return
 		}
 
-		streamDescription, err := sr.client.StreamDescription(sr.streamName)
+		streamNames, err := sr.streams()
 		if err != nil {
-			sr.err = err
+			sr.setErr(err)
 			sr.Close()
 			return
 		}
 
-		for _, shard := range streamDescription.Shards {
-			key := GetStreamKey(sr.streamName, *shard.ShardId, sr.clientName)
-			sc := runningConsumers[key]
+		seen := map[shardkey.ShardKey]bool{}
+		for _, streamName := range streamNames {
+			err = sr.updateStream(streamName, shards, seen)
+			if err != nil {
+				sr.setErr(err)
+				sr.Close()
+				return
+			}
+		}
+
+		sr.removeUnseen(shards, seen)
+	}
+}
 
-			// TODO async shard updater
-			sr.client.snitch.RegisterKey(key)
+// removeUnseen forgets the shards that were deleted or whose stream isn't selected anymore. Their consumers are handed
+// off like shards owned by someone else.
+func (sr *SharedReader) removeUnseen(shards *shardSet, seen map[shardkey.ShardKey]bool) {
+	for key, sc := range shards.consumers {
+		if seen[key] {
+			continue
+		}
 
-			if !sr.client.snitch.CheckOwnership(key) {
-				if sc != nil && sc.running {
-					sc.lockedReader.Close()
-				}
+		if !sr.startHandoff(sc) && sr.consumerState(sc) == consumerStopped {
+			delete(shards.consumers, key)
+		}
+	}
+
+	for key := range shards.registered {
+		if !seen[key] {
+			sr.client.snitch.UnregisterKey(key)
+			delete(shards.registered, key)
+		}
+	}
+
+	for key := range shards.retired {
+		if !seen[key] {
+			delete(shards.retired, key)
+		}
+	}
+}
+
+func (sr *SharedReader) updateStream(streamName string, shards *shardSet, seen map[shardkey.ShardKey]bool) error {
+	streamShards, err := sr.client.ListShards(streamName, nil)
+	if isResourceNotFound(err) {
+		// a stream matching a pattern may be deleted before the stream list is refreshed
+		Logger.Printf("Stream %s not found", streamName)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, shard := range streamShards {
+		key := sr.client.shardKey(streamName, *shard.ShardId, sr.clientName)
+		seen[key] = true
+
+		if shards.retired[key] {
+			continue
+		}
+
+		sc := shards.consumers[key]
+		if sc != nil && sr.consumerState(sc) == consumerStopped {
+			delete(shards.consumers, key)
+
+			// closed shards stay in the stream until their records expire but there is nothing left to read
+			if sc.lockedReader != nil && sc.lockedReader.IsShardEnded() {
+				shards.retired[key] = true
+				delete(shards.registered, key)
+				sr.client.snitch.UnregisterKey(key)
 				continue
 			}
+			sc = nil
+		}
 
-			if sc != nil && sc.running {
-				continue
+		// TODO async shard updater
+		sr.client.snitch.RegisterKey(key)
+		shards.registered[key] = true
+
+		if !sr.client.snitch.CheckOwnership(key) {
+			if sc != nil {
+				sr.startHandoff(sc)
 			}
+			continue
+		}
 
-			lockedReader, err := sr.client.NewLockedReaderWithParameters(sr.streamName, *shard.ShardId, sr.clientName, sr.streamReadInterval, sr.readBatchSize, sr.channelBufferSize)
-			if err == ErrShardLocked {
-				continue
-			} else if err != nil {
-				sr.err = err
-				sr.Close()
+		// a shard that is still handed off is acquired again once it's released
+		if sc != nil {
+			continue
+		}
+
+		sc = &shardConsumer{
+			key:        key,
+			streamName: streamName,
+			shardId:    *shard.ShardId,
+			state:      consumerAcquiring,
+			done:       make(chan struct{}),
+			stopped:    make(chan struct{}),
+			progress:   newShardProgress(),
+		}
+		shards.consumers[key] = sc
+
+		sr.consumerWg.Add(1)
+		go sr.acquireShard(sc)
+	}
+
+	return nil
+}
+
+// acquireShard waits for the previous owner to hand the shard off by releasing its lock and starts consuming it. It
+// gives up when the ownership is lost or the handoff times out.
+func (sr *SharedReader) acquireShard(sc *shardConsumer) {
+	defer sr.consumerWg.Done()
+
+	deadline := time.Now().Add(sr.handoffTimeout)
+	for {
+		if sr.isClosed() || !sr.client.snitch.CheckOwnership(sc.key) {
+			sr.setConsumerState(sc, consumerAcquiring, consumerStopped)
+			return
+		}
+
+		lockedReader, err := sr.client.NewLockedReaderWithParameters(sc.streamName, sc.shardId, sr.clientName, sr.streamReadInterval, sr.readBatchSize, sr.channelBufferSize)
+		if err == nil {
+			// the consumer is added unless the reader was closed in the meantime so Close and Drain see every reader
+			sr.closedMu.Lock()
+			closed := sr.closed
+			if !closed {
+				sr.consumersMu.Lock()
+				sr.consumers = append(sr.consumers, sc)
+				sc.lockedReader = lockedReader
+				sc.state = consumerRunning
+				sr.consumersMu.Unlock()
+			}
+			sr.closedMu.Unlock()
+
+			if closed {
+				lockedReader.Close()
+				if err := lockedReader.Release(); err != nil {
+					Logger.Printf("Release of shard %s failed: %v", sc.shardId, err)
+				}
+				sr.setConsumerState(sc, consumerAcquiring, consumerStopped)
 				return
 			}
 
-			sr.consumersMu.Lock()
-			sr.consumers = append(sr.consumers, lockedReader)
-			sr.consumersMu.Unlock()
+			sr.callHook(sr.onShardAcquired, sc)
+			sr.consumeShard(sc)
+			return
+		} else if err != ErrShardLocked {
+			sr.setErr(err)
+			sr.setConsumerState(sc, consumerAcquiring, consumerStopped)
+			sr.Close()
+			return
+		}
 
-			sc = &shardConsumer{
-				lockedReader: lockedReader,
-				running:      true,
-			}
-			runningConsumers[key] = sc
+		if time.Now().After(deadline) {
+			Logger.Printf("Handoff of shard %s timed out", sc.shardId)
+			sr.setConsumerState(sc, consumerAcquiring, consumerStopped)
+			return
+		}
+		time.Sleep(handoffPollInterval)
+	}
+}
+
+// startHandoff hands the shard off unless the consumer isn't running. The handoff is waited for before the records
+// channel is closed, a running consumer is still counted so adding it can't race with the wait.
+func (sr *SharedReader) startHandoff(sc *shardConsumer) bool {
+	if !sr.setConsumerState(sc, consumerRunning, consumerHandingOff) {
+		return false
+	}
+
+	sr.consumerWg.Add(1)
+	go sr.handoff(sc)
+	return true
+}
+
+// handoff stops reading a shard whose ownership moved to another reader. The records that were already read are
+// pushed to the records channel and checkpointed before the lock is released, which signals the new owner to start
+// reading after them.
+func (sr *SharedReader) handoff(sc *shardConsumer) {
+	defer sr.consumerWg.Done()
 
-			go sr.consumeShard(sc)
+	Logger.Printf("Handing off shard: %s", sc.shardId)
+
+	sc.lockedReader.Close()
+	<-sc.done
+
+	sr.finishConsumer(sc)
+	Logger.Printf("Handed off shard: %s", sc.shardId)
+}
+
+// finishConsumer checkpoints the records of a consumer that stopped reading, releases its lock and stops it. The
+// checkpoint is skipped when the lock was lost since the shard belongs to someone else.
+func (sr *SharedReader) finishConsumer(sc *shardConsumer) {
+	sr.waitProcessed(sc)
+
+	if !sc.lockedReader.IsLockLost() {
+		if err := sr.updateConsumerCheckpoint(sc); err != nil {
+			Logger.Printf("Checkpoint of shard %s failed: %v", sc.shardId, err)
 		}
 	}
+	if err := sc.lockedReader.Release(); err != nil {
+		Logger.Printf("Release of shard %s failed: %v", sc.shardId, err)
+	}
+	if sc.lockedReader.IsShardEnded() {
+		sr.callHook(sr.onShardEnded, sc)
+	} else {
+		sr.callHook(sr.onShardReleased, sc)
+	}
+
+	sr.setConsumerState(sc, consumerHandingOff, consumerStopped)
+}
+
+func (sr *SharedReader) callHook(hook ShardHook, sc *shardConsumer) {
+	if hook == nil {
+		return
+	}
+
+	checkpoint, err := sr.client.checkpoint.GetCheckpoint(sc.key)
+	if err != nil {
+		Logger.Printf("Checkpoint of shard %s can't be read: %v", sc.shardId, err)
+	}
+
+	hook(&ShardEvent{
+		StreamName: sc.streamName,
+		ShardId:    sc.shardId,
+		ClientName: sr.clientName,
+		Checkpoint: checkpoint,
+	})
+}
+
+func (sr *SharedReader) consumerState(sc *shardConsumer) int {
+	sr.consumersMu.Lock()
+	defer sr.consumersMu.Unlock()
+
+	return sc.state
+}
+
+// setConsumerState moves the consumer to state to if it's in state from.
+func (sr *SharedReader) setConsumerState(sc *shardConsumer, from, to int) bool {
+	sr.consumersMu.Lock()
+	defer sr.consumersMu.Unlock()
+
+	if sc.state != from {
+		return false
+	}
+	sc.state = to
+	if to == consumerStopped {
+		close(sc.stopped)
+	}
+	return true
 }
 
 func (sr *SharedReader) Close() error {
+	if sr.markClosed() {
+		go sr.stopConsumers()
+	}
+
+	return sr.firstErr()
+}
+
+// setErr keeps err unless the reader already stopped with an error.
+func (sr *SharedReader) setErr(err error) {
+	sr.errMu.Lock()
+	defer sr.errMu.Unlock()
+
+	if sr.err == nil {
+		sr.err = err
+	}
+}
+
+func (sr *SharedReader) firstErr() error {
+	sr.errMu.Lock()
+	defer sr.errMu.Unlock()
+
+	return sr.err
+}
+
+// markClosed reports whether the reader was open.
+func (sr *SharedReader) markClosed() bool {
 	sr.closedMu.Lock()
 	defer sr.closedMu.Unlock()
 
-	if !sr.closed {
-		sr.closed = true
-		go func() {
-			sr.consumerWg.Wait()
-			close(sr.recordsChan)
-		}()
+	if sr.closed {
+		return false
 	}
+	sr.closed = true
+	return true
+}
 
-	return sr.err
+// stopConsumers closes the readers of all shards and the records channel once their records were pushed to it and
+// all handoffs completed.
+func (sr *SharedReader) stopConsumers() {
+	sr.consumersMu.Lock()
+	consumers := append([]*shardConsumer{}, sr.consumers...)
+	sr.consumersMu.Unlock()
+
+	for _, c := range consumers {
+		c.lockedReader.Close()
+	}
+
+	sr.consumerWg.Wait()
+	close(sr.recordsChan)
+	if sr.taggedChan != nil {
+		close(sr.taggedChan)
+	}
+}
+
+func (sr *SharedReader) isClosed() bool {
+	sr.closedMu.Lock()
+	defer sr.closedMu.Unlock()
+
+	return sr.closed
 }
 
 func (sr *SharedReader) UpdateCheckpoint() error {
@@ -170,8 +540,13 @@ func (sr *SharedReader) UpdateCheckpoint() error {
 	newConsumers := sr.consumers[0:0]
 
 	for _, c := range sr.consumers {
-		closed := c.IsClosed()
-		err := c.UpdateCheckpoint()
+		// the shard is read by someone else now, its checkpoint must not be touched
+		if c.lockedReader.IsLockLost() {
+			continue
+		}
+
+		closed := c.lockedReader.IsClosed()
+		err := sr.updateConsumerCheckpoint(c)
 		if err != nil {
 			return err
 		}
@@ -184,3 +559,12 @@ func (sr *SharedReader) UpdateCheckpoint() error {
 
 	return nil
 }
+
+// updateConsumerCheckpoint checkpoints the last record that was read, or the last completed record when processing.
+func (sr *SharedReader) updateConsumerCheckpoint(sc *shardConsumer) error {
+	if sr.workers == nil {
+		return sc.lockedReader.UpdateCheckpoint()
+	}
+
+	return sc.progress.updateCheckpoint(sc.lockedReader)
+}
@@ -0,0 +1,235 @@
+package kcl
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+func init() {
+	streamConsumerUpdate = 10 * time.Millisecond
+	handoffPollInterval = 10 * time.Millisecond
+}
+
+func TestSharedReaderReleasesEndedShard(t *testing.T) {
+	fk := newFakeKinesis()
+	shard := fk.addShard("shard-0")
+	fk.putRecords(shard, 1000, 250, time.Now())
+	fk.closeShard(shard)
+
+	client := newTestClient(fk)
+	reader, err := client.NewSharedReaderWithParameters("stream", "client", time.Millisecond, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ended := make(chan *ShardEvent, 1)
+	reader.OnShardEnded(func(event *ShardEvent) {
+		ended <- event
+	})
+
+	records := reader.Records()
+	go func() {
+		for range records {
+		}
+	}()
+	defer reader.Close()
+
+	select {
+	case event := <-ended:
+		if event.Checkpoint != "1249" {
+			t.Errorf("Ended at checkpoint %q, expected 1249", event.Checkpoint)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shard didn't end")
+	}
+
+	locked, _ := client.distlock.IsLocked(shardkey.New("", "stream", "shard-0", "client"))
+	if locked {
+		t.Error("Ended shard is still locked")
+	}
+}
+
+func TestSharedReaderReleasesShardsOnClose(t *testing.T) {
+	fk := newFakeKinesis()
+	shard := fk.addShard("shard-0")
+	fk.putRecords(shard, 1000, 100, time.Now())
+
+	client := newTestClient(fk)
+	reader, err := client.NewSharedReaderWithParameters("stream", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := reader.Records()
+	last := ""
+	for record := range records {
+		last = aws.StringValue(record.SequenceNumber)
+		if last == "1049" {
+			reader.Close()
+		}
+	}
+
+	key := shardkey.New("", "stream", "shard-0", "client")
+	locked, _ := client.distlock.IsLocked(key)
+	if locked {
+		t.Error("Shard is still locked after Close")
+	}
+
+	checkpoint, _ := client.checkpoint.GetCheckpoint(key)
+	if checkpoint != last {
+		t.Errorf("Checkpoint is %q, expected the last delivered record %s", checkpoint, last)
+	}
+}
+
+func TestSharedReaderDrainCompletesBeforeChannelCloses(t *testing.T) {
+	fk := newFakeKinesis()
+	for i, shardId := range []string{"shard-0", "shard-1", "shard-2"} {
+		fk.putRecords(fk.addShard(shardId), (i+1)*10000, 1000, time.Now())
+	}
+
+	client := newTestClient(fk)
+	client.checkpoint.(*memCheckpointer).delay = 50 * time.Millisecond
+	reader, err := client.NewSharedReaderWithParameters("stream", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *ShardEvent, 3)
+	reader.OnShardAcquired(func(event *ShardEvent) {
+		acquired <- event
+	})
+
+	records := reader.Records()
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-acquired
+		}
+		reader.Drain(context.Background())
+	}()
+
+	last := map[string]string{}
+	for record := range records {
+		sequenceNumber := aws.StringValue(record.SequenceNumber)
+		last[fk.shardOf(sequenceNumber)] = sequenceNumber
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, shardId := range []string{"shard-0", "shard-1", "shard-2"} {
+		key := shardkey.New("", "stream", shardId, "client")
+		if locked, _ := client.distlock.IsLocked(key); locked {
+			t.Errorf("Shard %s is still locked after the records channel was closed", shardId)
+		}
+		if checkpoint, _ := client.checkpoint.GetCheckpoint(key); checkpoint != last[shardId] {
+			t.Errorf("Checkpoint of shard %s is %q, expected %q", shardId, checkpoint, last[shardId])
+		}
+	}
+}
+
+func TestSharedReaderHooksReportShardAndCheckpoint(t *testing.T) {
+	fk := newFakeKinesis()
+	fk.putRecords(fk.addShard("shard-0"), 1000, 20, time.Now())
+	fk.putRecords(fk.addShard("shard-1"), 2000, 20, time.Now())
+
+	client := newTestClient(fk)
+	client.checkpoint.SetCheckpoint(shardkey.New("", "stream", "shard-0", "client"), "1009")
+	reader, err := client.NewSharedReaderWithParameters("stream", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := map[string]*ShardEvent{}
+	released := map[string]*ShardEvent{}
+	mu := &sync.Mutex{}
+	record := func(events map[string]*ShardEvent) ShardHook {
+		return func(event *ShardEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events[event.ShardId] = event
+		}
+	}
+	reader.OnShardAcquired(record(acquired))
+	reader.OnShardReleased(record(released))
+
+	read := 0
+	for record := range reader.Records() {
+		if sequenceNumber := aws.StringValue(record.SequenceNumber); sequenceNumber == "1009" {
+			t.Errorf("Record %s before the checkpoint was read", sequenceNumber)
+		}
+		read++
+		if read == 30 {
+			reader.Close()
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := map[string][2]string{"shard-0": {"1009", "1019"}, "shard-1": {"", "2019"}}
+	for shardId, checkpoints := range expected {
+		for i, events := range []map[string]*ShardEvent{acquired, released} {
+			event := events[shardId]
+			if event == nil {
+				t.Errorf("Hook %d wasn't called for %s", i, shardId)
+				continue
+			}
+			if event.StreamName != "stream" || event.ClientName != "client" || event.Checkpoint != checkpoints[i] {
+				t.Errorf("Got event %+v, expected checkpoint %q of %s on stream", event, checkpoints[i], shardId)
+			}
+		}
+	}
+}
+
+func TestSharedReaderUnregistersEndedAndRemovedShards(t *testing.T) {
+	fk := newFakeKinesis()
+	ended := fk.addShard("shard-0")
+	fk.addShard("shard-1")
+	foreign := fk.addShard("shard-2")
+	fk.putRecords(ended, 1000, 20, time.Now())
+	fk.closeShard(ended)
+
+	endedKey := shardkey.New("", "stream", "shard-0", "client")
+	openKey := shardkey.New("", "stream", "shard-1", "client")
+	foreignKey := shardkey.New("", "stream", "shard-2", "client")
+
+	rs := newRecordingSnitcher(foreignKey)
+	client := newTestClient(fk)
+	client.snitch = rs
+
+	reader, err := client.NewSharedReaderWithParameters("stream", "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	records := reader.Records()
+	for i := 0; i < 20; i++ {
+		select {
+		case <-records:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Read %d records, expected 20", i)
+		}
+	}
+
+	// the ended shard is still listed but isn't competed for anymore
+	waitFor(t, func() bool {
+		return !rs.isRegistered(endedKey) && rs.isRegistered(openKey) && rs.isRegistered(foreignKey)
+	})
+	time.Sleep(5 * streamConsumerUpdate)
+	if rs.isRegistered(endedKey) {
+		t.Error("Ended shard was registered again")
+	}
+
+	// a deleted shard is forgotten even when it's owned by another reader
+	fk.removeShard(foreign)
+	waitFor(t, func() bool {
+		return !rs.isRegistered(foreignKey)
+	})
+	if !rs.isRegistered(openKey) {
+		t.Error("Open shard was unregistered")
+	}
+}
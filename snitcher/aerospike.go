@@ -1,208 +1,163 @@
 package snitcher
 
 import (
-	"math/rand"
-	"os"
-	"sort"
-	"sync"
 	"time"
 
 	"github.com/aerospike/aerospike-client-go"
 	"github.com/aerospike/aerospike-client-go/types"
+	"github.com/matijavizintin/go-kcl/shardkey"
 )
 
 const (
-	setName        = "kcl_snitcher"
-	aerospikeTTL   = 5
-	updateInterval = time.Second
+	setName      = "kcl_snitcher"
+	aerospikeTTL = 5
 )
 
-type AerospikeSnitcher struct {
-	client    *aerospike.Client
-	namespace string
-	clientId  string
+var claimBins = []string{"key", "weight", "cost", "clientId", "hostname", "ts"}
 
-	candidates       map[string]*candidate
-	sortedCandidates []*candidate
-	candidatesMu     sync.RWMutex
-
-	rand *rand.Rand
-}
-
-type candidate struct {
-	key    string
-	winner bool
-	order  float64
+// AerospikeSnitcher is a BalancingSnitcher that keeps its claims in Aerospike.
+type AerospikeSnitcher struct {
+	*BalancingSnitcher
 }
 
 func NewAerospikeSnitcher(client *aerospike.Client, namespace string) *AerospikeSnitcher {
-	clientId, _ := newUUID()
+	return NewAerospikeSnitcherWithParameters(client, namespace, NewEvenStrategy())
+}
 
-	ae := &AerospikeSnitcher{
-		client:     client,
-		namespace:  namespace,
-		clientId:   clientId,
-		candidates: map[string]*candidate{},
-		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+func NewAerospikeSnitcherWithParameters(client *aerospike.Client, namespace string, strategy BalancingStrategy) *AerospikeSnitcher {
+	return &AerospikeSnitcher{
+		BalancingSnitcher: NewBalancingSnitcher(NewAerospikeStore(client, namespace), strategy),
 	}
+}
 
-	go ae.runSnitchers()
+// AerospikeStore is a Store that keeps claims in Aerospike records that expire after aerospikeTTL seconds.
+type AerospikeStore struct {
+	client    *aerospike.Client
+	namespace string
+}
 
-	return ae
+func NewAerospikeStore(client *aerospike.Client, namespace string) *AerospikeStore {
+	return &AerospikeStore{
+		client:    client,
+		namespace: namespace,
+	}
 }
 
-func (ae *AerospikeSnitcher) getRecord(key *aerospike.Key) (*aerospike.Record, string, float64, error) {
-	record, err := ae.client.Get(nil, key, setName, "weight", "clientId")
+func (as *AerospikeStore) Get(key shardkey.ShardKey) (*Claim, error) {
+	asKey, err := aerospike.NewKey(as.namespace, setName, key.String())
 	if err != nil {
-		return nil, "", -1, err
+		return nil, err
 	}
 
-	weight := -1.0
-	clientId := ""
-	if record != nil {
-		s, ok := record.Bins["weight"]
-		if ok {
-			weight = s.(float64)
-		}
-		cid, ok := record.Bins["clientId"]
-		if ok {
-			clientId = cid.(string)
-		}
+	record, err := as.client.Get(nil, asKey, claimBins...)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, nil
 	}
 
-	return record, clientId, weight, nil
+	return decodeClaim(record), nil
 }
 
-func (ae *AerospikeSnitcher) updateRecord(record *aerospike.Record, key *aerospike.Key, candidate *candidate, weight float64) error {
-	ts := time.Now().UTC().Format(time.RFC3339)
-
-	hostname, err := os.Hostname()
+func (as *AerospikeStore) Put(key shardkey.ShardKey, claim *Claim, current *Claim) (bool, error) {
+	asKey, err := aerospike.NewKey(as.namespace, setName, key.String())
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	policy := aerospike.NewWritePolicy(0, aerospikeTTL)
-	if record != nil {
-		policy.Generation = record.Generation
+	if current != nil {
+		policy.Generation = current.Generation
 		policy.GenerationPolicy = aerospike.EXPECT_GEN_EQUAL
 	} else {
 		policy.RecordExistsAction = aerospike.CREATE_ONLY
 	}
 
-	err = ae.client.PutBins(
+	err = as.client.PutBins(
 		policy,
-		key,
-		aerospike.NewBin("key", candidate.key),
-		aerospike.NewBin("weight", weight),
-		aerospike.NewBin("clientId", ae.clientId),
-		aerospike.NewBin("hostname", hostname),
-		aerospike.NewBin("ts", ts),
+		asKey,
+		aerospike.NewBin("key", key.String()),
+		aerospike.NewBin("weight", claim.Weight),
+		aerospike.NewBin("cost", claim.Cost),
+		aerospike.NewBin("clientId", claim.ClientId),
+		aerospike.NewBin("hostname", claim.Hostname),
+		aerospike.NewBin("ts", time.Now().UTC().Format(time.RFC3339Nano)),
 	)
 	if aserr, ok := err.(types.AerospikeError); ok && (aserr.ResultCode() == types.KEY_EXISTS_ERROR || aserr.ResultCode() == types.GENERATION_ERROR) {
-		return nil
+		return false, nil
 	} else if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return true, nil
 }
 
-func (ae *AerospikeSnitcher) runSnitchers() {
-	for range time.Tick(updateInterval) {
-		ae.candidatesMu.RLock()
-		candidatesCopy := append([]*candidate{}, ae.sortedCandidates...)
-		ae.candidatesMu.RUnlock()
-
-		ownSeq := 0.0
-		newOwnership := false
-		for _, candidate := range candidatesCopy {
-			asKey, err := aerospike.NewKey(ae.namespace, setName, candidate.key)
-			if err != nil {
-				Logger.Print(err)
-				continue
-			}
-
-			record, currentClientId, currentWeight, err := ae.getRecord(asKey)
-
-			newWeight := ownSeq
-			if currentClientId != "" && ae.clientId != currentClientId {
-				if newWeight+1.0 > currentWeight {
-					if candidate.winner {
-						Logger.Print("Ownership lost: ", candidate.key)
-						candidate.winner = false
-					}
-					continue
-				}
-				if newOwnership {
-					// One new shard per cycle
-					continue
-				}
-			}
-
-			err = ae.updateRecord(record, asKey, candidate, newWeight)
-			if err != nil {
-				Logger.Print(err)
-				continue
-			}
-
-			_, newClientId, _, err := ae.getRecord(asKey)
-			if err != nil {
-				Logger.Print(err)
-				continue
-			}
-
-			// Check for database race
-			if ae.clientId == newClientId {
-				ownSeq += 1.0
-
-				if !candidate.winner {
-					candidate.winner = true
-					newOwnership = true
-					Logger.Print("Ownership won: ", candidate.key)
-				}
-			} else {
-				if candidate.winner {
-					candidate.winner = false
-					Logger.Print("Ownership lost: ", candidate.key)
-				}
-			}
-		}
+func (as *AerospikeStore) Delete(key shardkey.ShardKey, current *Claim) (bool, error) {
+	asKey, err := aerospike.NewKey(as.namespace, setName, key.String())
+	if err != nil {
+		return false, err
 	}
-}
 
-func (ae *AerospikeSnitcher) CheckOwnership(key string) bool {
-	ae.candidatesMu.RLock()
-	w, ok := ae.candidates[key]
-	ae.candidatesMu.RUnlock()
+	policy := aerospike.NewWritePolicy(current.Generation, 0)
+	policy.GenerationPolicy = aerospike.EXPECT_GEN_EQUAL
 
-	if !ok {
-		return false
+	existed, err := as.client.Delete(policy, asKey)
+	if aserr, ok := err.(types.AerospikeError); ok && aserr.ResultCode() == types.GENERATION_ERROR {
+		return false, nil
+	} else if err != nil {
+		return false, err
 	}
 
-	return w.winner
+	return existed, nil
 }
 
-func (ae *AerospikeSnitcher) RegisterKey(key string) {
-	ae.candidatesMu.RLock()
-	_, ok := ae.candidates[key]
-	ae.candidatesMu.RUnlock()
-
-	if ok {
-		return
+// List scans the claims of all keys.
+func (as *AerospikeStore) List() (map[shardkey.ShardKey]*Claim, error) {
+	recordset, err := as.client.ScanAll(aerospike.NewScanPolicy(), as.namespace, setName, claimBins...)
+	if err != nil {
+		return nil, err
 	}
+	defer recordset.Close()
+
+	claims := map[shardkey.ShardKey]*Claim{}
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return nil, res.Err
+		}
 
-	c := &candidate{
-		key:   key,
-		order: ae.rand.Float64(),
+		encoded, _ := res.Record.Bins["key"].(string)
+		key, err := shardkey.Parse(encoded)
+		if err != nil {
+			continue
+		}
+
+		claims[key] = decodeClaim(res.Record)
 	}
 
-	ae.candidatesMu.Lock()
-	defer ae.candidatesMu.Unlock()
+	return claims, nil
+}
 
-	ae.candidates[key] = c
-	ae.sortedCandidates = append(ae.sortedCandidates, c)
+func decodeClaim(record *aerospike.Record) *Claim {
+	claim := &Claim{
+		Weight:     -1,
+		Generation: record.Generation,
+	}
+	if weight, ok := record.Bins["weight"].(float64); ok {
+		claim.Weight = weight
+	}
+	if cost, ok := record.Bins["cost"].(float64); ok {
+		claim.Cost = cost
+	}
+	if clientId, ok := record.Bins["clientId"].(string); ok {
+		claim.ClientId = clientId
+	}
+	if hostname, ok := record.Bins["hostname"].(string); ok {
+		claim.Hostname = hostname
+	}
+	if ts, ok := record.Bins["ts"].(string); ok {
+		claim.Heartbeat, _ = time.Parse(time.RFC3339Nano, ts)
+	}
 
-	sort.Slice(ae.sortedCandidates, func(i, j int) bool {
-		return ae.sortedCandidates[i].order < ae.sortedCandidates[j].order
-	})
+	return claim
 }
@@ -0,0 +1,362 @@
+package snitcher
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+const updateInterval = time.Second
+
+// BalancingSnitcher claims keys in a Store shared by all snitchers of a client group and spreads them with a
+// BalancingStrategy.
+type BalancingSnitcher struct {
+	store    Store
+	strategy BalancingStrategy
+	clientId string
+	hostname string
+	interval time.Duration
+
+	candidates       map[shardkey.ShardKey]*candidate
+	sortedCandidates []*candidate
+	candidatesMu     sync.RWMutex
+
+	rand     *rand.Rand
+	stop     chan struct{}
+	stopOnce sync.Once
+	// stopped is closed when the last update finished
+	stopped chan struct{}
+}
+
+type candidate struct {
+	key     shardkey.ShardKey
+	winner  bool
+	retired bool
+	order   float64
+}
+
+func NewBalancingSnitcher(store Store, strategy BalancingStrategy) *BalancingSnitcher {
+	return NewBalancingSnitcherWithParameters(store, strategy, updateInterval)
+}
+
+// NewBalancingSnitcherWithParameters initializes a snitcher that updates its claims every interval. The interval has
+// to be shorter than the TTL of the store's claims.
+func NewBalancingSnitcherWithParameters(store Store, strategy BalancingStrategy, interval time.Duration) *BalancingSnitcher {
+	clientId, _ := newUUID()
+	hostname, _ := os.Hostname()
+
+	bs := &BalancingSnitcher{
+		store:      store,
+		strategy:   strategy,
+		clientId:   clientId,
+		hostname:   hostname,
+		interval:   interval,
+		candidates: map[shardkey.ShardKey]*candidate{},
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	go bs.runSnitchers()
+
+	return bs
+}
+
+func (bs *BalancingSnitcher) CheckOwnership(key shardkey.ShardKey) bool {
+	bs.candidatesMu.RLock()
+	defer bs.candidatesMu.RUnlock()
+
+	w, ok := bs.candidates[key]
+	if !ok {
+		return false
+	}
+
+	return w.winner
+}
+
+func (bs *BalancingSnitcher) RegisterKey(key shardkey.ShardKey) {
+	bs.candidatesMu.RLock()
+	_, ok := bs.candidates[key]
+	bs.candidatesMu.RUnlock()
+
+	if ok {
+		return
+	}
+
+	bs.candidatesMu.Lock()
+	defer bs.candidatesMu.Unlock()
+
+	if _, ok := bs.candidates[key]; ok {
+		return
+	}
+
+	c := &candidate{
+		key:   key,
+		order: bs.rand.Float64(),
+	}
+
+	bs.candidates[key] = c
+	bs.sortedCandidates = append(bs.sortedCandidates, c)
+
+	sort.Slice(bs.sortedCandidates, func(i, j int) bool {
+		return bs.sortedCandidates[i].order < bs.sortedCandidates[j].order
+	})
+}
+
+func (bs *BalancingSnitcher) UnregisterKey(key shardkey.ShardKey) {
+	bs.candidatesMu.Lock()
+	defer bs.candidatesMu.Unlock()
+
+	c, ok := bs.candidates[key]
+	if !ok {
+		return
+	}
+
+	delete(bs.candidates, key)
+	for i, sorted := range bs.sortedCandidates {
+		if sorted == c {
+			bs.sortedCandidates = append(bs.sortedCandidates[:i], bs.sortedCandidates[i+1:]...)
+			break
+		}
+	}
+
+	// the claim isn't renewed anymore and expires after the TTL of the store
+	c.retired = true
+	if c.winner {
+		c.winner = false
+		Logger.Print("Ownership retired: ", key)
+	}
+}
+
+// Observe reports bytes read from the key to strategies that measure load.
+func (bs *BalancingSnitcher) Observe(key shardkey.ShardKey, bytes int) {
+	if observer, ok := bs.strategy.(LoadObserver); ok {
+		observer.Observe(key, bytes)
+	}
+}
+
+// ClientId returns the id the snitcher claims keys with.
+func (bs *BalancingSnitcher) ClientId() string {
+	return bs.clientId
+}
+
+// Assignments returns the current claims of the keys registered with the snitcher.
+func (bs *BalancingSnitcher) Assignments() ([]*Assignment, error) {
+	bs.candidatesMu.RLock()
+	keys := make([]shardkey.ShardKey, 0, len(bs.candidates))
+	for key := range bs.candidates {
+		keys = append(keys, key)
+	}
+	bs.candidatesMu.RUnlock()
+
+	assignments := make([]*Assignment, 0, len(keys))
+	for _, key := range keys {
+		claim, err := bs.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		assignments = append(assignments, bs.assignment(key, claim))
+	}
+
+	sortAssignments(assignments)
+	return assignments, nil
+}
+
+// ClusterAssignments returns the claims of all snitchers sharing the store. It requires a ListableStore.
+func (bs *BalancingSnitcher) ClusterAssignments() ([]*Assignment, error) {
+	listable, ok := bs.store.(ListableStore)
+	if !ok {
+		return nil, ErrStoreNotListable
+	}
+
+	claims, err := listable.List()
+	if err != nil {
+		return nil, err
+	}
+
+	assignments := make([]*Assignment, 0, len(claims))
+	for key, claim := range claims {
+		assignments = append(assignments, bs.assignment(key, claim))
+	}
+
+	sortAssignments(assignments)
+	return assignments, nil
+}
+
+func (bs *BalancingSnitcher) assignment(key shardkey.ShardKey, claim *Claim) *Assignment {
+	if claim == nil {
+		return &Assignment{Key: key}
+	}
+
+	return &Assignment{
+		Key:       key,
+		ClientId:  claim.ClientId,
+		Hostname:  claim.Hostname,
+		Weight:    claim.Weight,
+		Cost:      claim.Cost,
+		Heartbeat: claim.Heartbeat,
+		Local:     claim.ClientId == bs.clientId,
+	}
+}
+
+// Close stops updating claims. The claims expire after the TTL of the store and are taken over by other snitchers.
+func (bs *BalancingSnitcher) Close() {
+	bs.stopOnce.Do(func() {
+		close(bs.stop)
+	})
+}
+
+// Drain stops updating claims and deletes the claims of the keys it owns so other snitchers can claim them right away.
+func (bs *BalancingSnitcher) Drain(ctx context.Context) error {
+	bs.Close()
+
+	select {
+	case <-bs.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	bs.candidatesMu.Lock()
+	owned := []*candidate{}
+	for _, c := range bs.sortedCandidates {
+		if c.winner {
+			owned = append(owned, c)
+		}
+		c.winner = false
+	}
+	bs.candidatesMu.Unlock()
+
+	for _, c := range owned {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		claim, err := bs.store.Get(c.key)
+		if err != nil {
+			return err
+		}
+		if claim == nil || claim.ClientId != bs.clientId {
+			continue
+		}
+
+		// a claim that changed in the meantime isn't ours anymore
+		_, err = bs.store.Delete(c.key, claim)
+		if err != nil {
+			return err
+		}
+		Logger.Print("Ownership given up: ", c.key)
+	}
+
+	return nil
+}
+
+func (bs *BalancingSnitcher) runSnitchers() {
+	defer close(bs.stopped)
+
+	ticker := time.NewTicker(bs.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-bs.stop:
+			return
+		}
+
+		bs.update()
+	}
+}
+
+// update walks the keys in their random order and claims them with the load owned before each key as the weight, keys
+// that were unregistered are skipped so they don't add to the load. A key of another snitcher is taken over only if
+// the load including it stays at or below the owner's weight, and at most one new key is won per cycle so ownership
+// moves gradually.
+func (bs *BalancingSnitcher) update() {
+	bs.candidatesMu.RLock()
+	candidatesCopy := append([]*candidate{}, bs.sortedCandidates...)
+	bs.candidatesMu.RUnlock()
+
+	ownLoad := 0.0
+	owned := 0
+	newOwnership := false
+	for _, candidate := range candidatesCopy {
+		// keys may be unregistered while the cycle runs
+		if bs.isRetired(candidate) {
+			continue
+		}
+
+		claim, err := bs.store.Get(candidate.key)
+		if err != nil {
+			Logger.Print(err)
+			continue
+		}
+
+		cost := bs.strategy.Cost(candidate.key)
+		foreign := claim != nil && claim.ClientId != bs.clientId
+		if foreign && claim.Cost > 0 {
+			cost = claim.Cost
+		}
+
+		if !bs.strategy.CanOwn(owned) || foreign && (ownLoad+cost > claim.Weight || newOwnership) {
+			bs.lose(candidate)
+			continue
+		}
+
+		won, err := bs.store.Put(candidate.key, &Claim{
+			ClientId: bs.clientId,
+			Hostname: bs.hostname,
+			Weight:   ownLoad,
+			Cost:     cost,
+		}, claim)
+		if err != nil {
+			Logger.Print(err)
+			continue
+		}
+		// Check for database race
+		if !won {
+			bs.lose(candidate)
+			continue
+		}
+
+		ownLoad += cost
+		owned++
+
+		if bs.setWinner(candidate, true) {
+			newOwnership = true
+			Logger.Print("Ownership won: ", candidate.key)
+		}
+	}
+}
+
+func (bs *BalancingSnitcher) lose(candidate *candidate) {
+	if bs.setWinner(candidate, false) {
+		Logger.Print("Ownership lost: ", candidate.key)
+	}
+}
+
+func (bs *BalancingSnitcher) isRetired(candidate *candidate) bool {
+	bs.candidatesMu.RLock()
+	defer bs.candidatesMu.RUnlock()
+
+	return candidate.retired
+}
+
+// setWinner reports whether the ownership of the candidate changed.
+func (bs *BalancingSnitcher) setWinner(candidate *candidate, winner bool) bool {
+	bs.candidatesMu.Lock()
+	defer bs.candidatesMu.Unlock()
+
+	if candidate.retired {
+		return false
+	}
+
+	changed := candidate.winner != winner
+	candidate.winner = winner
+	return changed
+}
@@ -0,0 +1,204 @@
+package snitcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+const (
+	balancingTestInterval = 10 * time.Millisecond
+	balancingTestTTL      = 100 * time.Millisecond
+	// the split has to hold for this many consecutive checks to count as converged
+	balancingTestStableChecks = 20
+)
+
+func init() {
+	Logger.SetOutput(ioutil.Discard)
+}
+
+func newBalancingSnitchers(count int, keys int, strategy func() BalancingStrategy) []*BalancingSnitcher {
+	store := NewMemoryStore(balancingTestTTL)
+
+	snitchers := []*BalancingSnitcher{}
+	for i := 0; i < count; i++ {
+		bs := NewBalancingSnitcherWithParameters(store, strategy(), balancingTestInterval)
+		for k := 0; k < keys; k++ {
+			bs.RegisterKey(balancingTestKey(k))
+		}
+		snitchers = append(snitchers, bs)
+	}
+	return snitchers
+}
+
+func balancingTestKey(i int) shardkey.ShardKey {
+	return shardkey.New("", "stream", fmt.Sprintf("shard-%d", i), "group")
+}
+
+// ownedKeys returns the number of keys every snitcher owns, or false if a key is owned by more than one snitcher.
+func ownedKeys(snitchers []*BalancingSnitcher, keys int) ([]int, bool) {
+	owned := make([]int, len(snitchers))
+	for k := 0; k < keys; k++ {
+		owners := 0
+		for i, bs := range snitchers {
+			if bs.CheckOwnership(balancingTestKey(k)) {
+				owned[i]++
+				owners++
+			}
+		}
+		if owners > 1 {
+			return owned, false
+		}
+	}
+	return owned, true
+}
+
+// waitForSplit waits until the split of keys is accepted by balanced for balancingTestStableChecks checks in a row.
+func waitForSplit(t *testing.T, snitchers []*BalancingSnitcher, keys int, balanced func(owned []int) bool) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	var owned []int
+	stable := 0
+	for stable < balancingTestStableChecks {
+		if time.Now().After(deadline) {
+			t.Fatalf("Keys did not converge to a balanced split, last split %v", owned)
+		}
+		time.Sleep(balancingTestInterval)
+
+		var exclusive bool
+		owned, exclusive = ownedKeys(snitchers, keys)
+		if exclusive && balanced(owned) {
+			stable++
+		} else {
+			stable = 0
+		}
+	}
+}
+
+func closeSnitchers(snitchers []*BalancingSnitcher) {
+	for _, bs := range snitchers {
+		bs.Close()
+	}
+}
+
+func TestBalancingSnitchersConverge(t *testing.T) {
+	const keys = 30
+
+	snitchers := newBalancingSnitchers(3, keys, func() BalancingStrategy {
+		return NewEvenStrategy()
+	})
+	defer closeSnitchers(snitchers)
+
+	// a snitcher takes over a key only while its load stays at or below the owner's, the split may be off by one
+	waitForSplit(t, snitchers, keys, func(owned []int) bool {
+		total := 0
+		for _, n := range owned {
+			total += n
+			if n < keys/3-1 || n > keys/3+1 {
+				return false
+			}
+		}
+		return total == keys
+	})
+}
+
+func TestBalancingSnitchersRespectMaxShards(t *testing.T) {
+	const keys = 20
+	const maxShards = 6
+
+	snitchers := newBalancingSnitchers(2, keys, func() BalancingStrategy {
+		return NewMaxShardsStrategy(NewEvenStrategy(), maxShards)
+	})
+	defer closeSnitchers(snitchers)
+
+	// every snitcher fills up to the cap and the remaining keys stay unowned
+	waitForSplit(t, snitchers, keys, func(owned []int) bool {
+		for _, n := range owned {
+			if n > maxShards {
+				t.Fatalf("Snitcher owns %d keys, at most %d are allowed", n, maxShards)
+			}
+			if n != maxShards {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestBalancingSnitcherAssignments(t *testing.T) {
+	store := NewMemoryStore(balancingTestTTL)
+	snitchers := []*BalancingSnitcher{
+		NewBalancingSnitcherWithParameters(store, NewEvenStrategy(), balancingTestInterval),
+		NewBalancingSnitcherWithParameters(store, NewEvenStrategy(), balancingTestInterval),
+	}
+	defer closeSnitchers(snitchers)
+
+	// every snitcher competes for its own keys only so it wins all of them
+	for k := 0; k < 4; k++ {
+		snitchers[k/2].RegisterKey(balancingTestKey(k))
+	}
+	waitForSplit(t, snitchers, 4, func(owned []int) bool {
+		return owned[0] == 2 && owned[1] == 2
+	})
+
+	local, err := snitchers[0].Assignments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local) != 2 {
+		t.Fatalf("Got %d local assignments, expected 2", len(local))
+	}
+	for k, assignment := range local {
+		if assignment.Key != balancingTestKey(k) || assignment.ClientId != snitchers[0].ClientId() || !assignment.Local {
+			t.Errorf("Local assignment %d is %+v", k, assignment)
+		}
+	}
+
+	cluster, err := snitchers[0].ClusterAssignments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cluster) != 4 {
+		t.Fatalf("Got %d cluster assignments, expected 4", len(cluster))
+	}
+	for k, assignment := range cluster {
+		owner := snitchers[k/2]
+		if assignment.Key != balancingTestKey(k) || assignment.ClientId != owner.ClientId() || assignment.Local != (k < 2) {
+			t.Errorf("Cluster assignment %d is %+v", k, assignment)
+		}
+	}
+}
+
+func TestBalancingSnitcherUnregisteredKeyFreesLoad(t *testing.T) {
+	snitchers := newBalancingSnitchers(1, 2, func() BalancingStrategy {
+		return NewMaxShardsStrategy(NewEvenStrategy(), 1)
+	})
+	defer closeSnitchers(snitchers)
+	bs := snitchers[0]
+
+	waitForSplit(t, snitchers, 2, func(owned []int) bool {
+		return owned[0] == 1
+	})
+
+	owned, other := balancingTestKey(0), balancingTestKey(1)
+	if !bs.CheckOwnership(owned) {
+		owned, other = other, owned
+	}
+
+	// the unregistered key isn't owned and doesn't count toward the cap, so the other key is taken
+	bs.UnregisterKey(owned)
+	waitForSplit(t, snitchers, 2, func([]int) bool {
+		return !bs.CheckOwnership(owned) && bs.CheckOwnership(other)
+	})
+
+	assignments, err := bs.Assignments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assignments) != 1 || assignments[0].Key != other {
+		t.Errorf("Got assignments %v, expected only %v", assignments, other)
+	}
+}
@@ -0,0 +1,241 @@
+package snitcher
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+const gossipLeaveTimeout = time.Second * 5
+
+var ErrNoSeeds = errors.New("No seeds could be joined")
+
+// GossipSnitcher discovers the snitchers of a client group with the memberlist gossip protocol and assigns every key to
+// one member with rendezvous hashing. Ownership is decided locally without a store, when a member joins or fails only
+// the keys it gains or owned move, as soon as the failure is detected by the protocol.
+type GossipSnitcher struct {
+	members *memberlist.Memberlist
+	name    string
+
+	keys   map[shardkey.ShardKey]bool
+	keysMu sync.Mutex
+
+	closed    bool
+	closeOnce sync.Once
+}
+
+// NewGossipSnitcher joins the cluster through seeds (host:port of any existing members) with the default LAN settings.
+// An empty list of seeds starts a new cluster.
+func NewGossipSnitcher(bindPort int, seeds []string) (*GossipSnitcher, error) {
+	config := memberlist.DefaultLANConfig()
+	config.BindPort = bindPort
+	config.AdvertisePort = bindPort
+
+	return NewGossipSnitcherWithParameters(config, seeds)
+}
+
+// NewGossipSnitcherWithParameters joins the cluster with a custom memberlist config. Member names have to be unique so
+// an empty name or the hostname, memberlist's default, gets a random suffix. A restarted process then joins as a new
+// member instead of conflicting with its old self until it's declared dead.
+func NewGossipSnitcherWithParameters(config *memberlist.Config, seeds []string) (*GossipSnitcher, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if config.Name == "" || config.Name == hostname {
+		suffix, err := newUUID()
+		if err != nil {
+			return nil, err
+		}
+		config.Name = hostname + "-" + suffix
+	}
+
+	gs := &GossipSnitcher{
+		name: config.Name,
+		keys: map[shardkey.ShardKey]bool{},
+	}
+	if config.Events == nil {
+		config.Events = gs
+	}
+
+	members, err := memberlist.Create(config)
+	if err != nil {
+		return nil, err
+	}
+	gs.members = members
+
+	if len(seeds) > 0 {
+		_, err = members.Join(seeds)
+		if err != nil {
+			members.Shutdown()
+			return nil, ErrNoSeeds
+		}
+	}
+
+	return gs, nil
+}
+
+func (gs *GossipSnitcher) RegisterKey(key shardkey.ShardKey) {
+	gs.keysMu.Lock()
+	defer gs.keysMu.Unlock()
+
+	gs.keys[key] = true
+}
+
+func (gs *GossipSnitcher) UnregisterKey(key shardkey.ShardKey) {
+	gs.keysMu.Lock()
+	defer gs.keysMu.Unlock()
+
+	delete(gs.keys, key)
+}
+
+func (gs *GossipSnitcher) CheckOwnership(key shardkey.ShardKey) bool {
+	gs.keysMu.Lock()
+	registered := gs.keys[key] && !gs.closed
+	gs.keysMu.Unlock()
+
+	if !registered {
+		return false
+	}
+
+	return gs.owner(key) == gs.name
+}
+
+// Name returns the name of the member in the cluster.
+func (gs *GossipSnitcher) Name() string {
+	return gs.name
+}
+
+// Close leaves the cluster so the other members take over the keys immediately instead of waiting for the failure to
+// be detected.
+func (gs *GossipSnitcher) Close() {
+	gs.leave(gossipLeaveTimeout)
+}
+
+// Drain leaves the cluster like Close and waits for the leave to be broadcast until ctx is done.
+func (gs *GossipSnitcher) Drain(ctx context.Context) error {
+	timeout := gossipLeaveTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	gs.leave(timeout)
+	return ctx.Err()
+}
+
+func (gs *GossipSnitcher) leave(timeout time.Duration) {
+	gs.closeOnce.Do(func() {
+		gs.keysMu.Lock()
+		gs.closed = true
+		gs.keysMu.Unlock()
+
+		err := gs.members.Leave(timeout)
+		if err != nil {
+			Logger.Print(err)
+		}
+
+		err = gs.members.Shutdown()
+		if err != nil {
+			Logger.Print(err)
+		}
+	})
+}
+
+func (gs *GossipSnitcher) NotifyJoin(node *memberlist.Node) {
+	Logger.Print("Member joined: ", node.Name)
+}
+
+func (gs *GossipSnitcher) NotifyLeave(node *memberlist.Node) {
+	Logger.Print("Member left: ", node.Name)
+}
+
+func (gs *GossipSnitcher) NotifyUpdate(node *memberlist.Node) {
+}
+
+// Assignments returns the owners of the registered keys. Members only know about each other, not about their keys, so
+// the assignments have no weight, cost or heartbeat.
+func (gs *GossipSnitcher) Assignments() ([]*Assignment, error) {
+	gs.keysMu.Lock()
+	keys := make([]shardkey.ShardKey, 0, len(gs.keys))
+	for key := range gs.keys {
+		keys = append(keys, key)
+	}
+	gs.keysMu.Unlock()
+
+	nodes := gs.members.Members()
+	names := make([]string, 0, len(nodes))
+	hostnames := map[string]string{}
+	for _, node := range nodes {
+		names = append(names, node.Name)
+		if len(node.Addr) > 0 {
+			hostnames[node.Name] = node.Addr.String()
+		}
+	}
+
+	assignments := make([]*Assignment, 0, len(keys))
+	for _, key := range keys {
+		owner := rendezvousOwner(key.String(), names)
+		assignments = append(assignments, &Assignment{
+			Key:      key,
+			ClientId: owner,
+			Hostname: hostnames[owner],
+			Local:    owner == gs.name,
+		})
+	}
+
+	sortAssignments(assignments)
+	return assignments, nil
+}
+
+// ClusterAssignments returns the same assignments as Assignments since keys aren't gossiped. The members of a client
+// group read the same streams and register the same keys, so these are the owners of the group's keys.
+func (gs *GossipSnitcher) ClusterAssignments() ([]*Assignment, error) {
+	return gs.Assignments()
+}
+
+func (gs *GossipSnitcher) owner(key shardkey.ShardKey) string {
+	nodes := gs.members.Members()
+
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+
+	return rendezvousOwner(key.String(), names)
+}
+
+// rendezvousOwner returns the member with the highest hash of the member and the key.
+func rendezvousOwner(key string, members []string) string {
+	owner := ""
+	var highest uint64
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(member))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+
+		score := mix64(h.Sum64())
+		if owner == "" || score > highest || score == highest && member < owner {
+			owner = member
+			highest = score
+		}
+	}
+
+	return owner
+}
+
+// mix64 spreads the bits of fnv hashes of similar inputs.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9a3fe1a85ec
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,139 @@
+package snitcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+const gossipTestKeys = 64
+
+// newGossipCluster starts size members on the loopback interface, every one joins through the first.
+func newGossipCluster(t *testing.T, size int) []*GossipSnitcher {
+	snitchers := []*GossipSnitcher{}
+	for i := 0; i < size; i++ {
+		config := memberlist.DefaultLocalConfig()
+		config.Name = fmt.Sprintf("member-%d", i)
+		config.BindAddr = "127.0.0.1"
+		config.BindPort = 0
+		config.LogOutput = ioutil.Discard
+
+		seeds := []string{}
+		if i > 0 {
+			seeds = append(seeds, snitchers[0].members.LocalNode().Address())
+		}
+
+		gs, err := NewGossipSnitcherWithParameters(config, seeds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snitchers = append(snitchers, gs)
+	}
+
+	waitForMembers(t, snitchers, size)
+	return snitchers
+}
+
+func waitForMembers(t *testing.T, snitchers []*GossipSnitcher, size int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for _, gs := range snitchers {
+		for gs.members.NumMembers() != size {
+			if time.Now().After(deadline) {
+				t.Fatalf("Member %s sees %d members, expected %d", gs.Name(), gs.members.NumMembers(), size)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func gossipTestKey(i int) shardkey.ShardKey {
+	return shardkey.New("", "stream", fmt.Sprintf("shard-%d", i), "group")
+}
+
+// owners returns the owner of every test key and fails unless every key is owned by exactly one of the snitchers.
+func owners(t *testing.T, snitchers []*GossipSnitcher) map[shardkey.ShardKey]string {
+	owners := map[shardkey.ShardKey]string{}
+	for i := 0; i < gossipTestKeys; i++ {
+		key := gossipTestKey(i)
+		for _, gs := range snitchers {
+			if !gs.CheckOwnership(key) {
+				continue
+			}
+			if owners[key] != "" {
+				t.Errorf("Key %s is owned by %s and %s", key, owners[key], gs.Name())
+			}
+			owners[key] = gs.Name()
+		}
+		if owners[key] == "" {
+			t.Errorf("Key %s has no owner", key)
+		}
+	}
+	return owners
+}
+
+func TestGossipSnitcherRebalancesOnLeave(t *testing.T) {
+	snitchers := newGossipCluster(t, 3)
+	defer func() {
+		for _, gs := range snitchers {
+			gs.Close()
+		}
+	}()
+
+	for _, gs := range snitchers {
+		for i := 0; i < gossipTestKeys; i++ {
+			gs.RegisterKey(gossipTestKey(i))
+		}
+	}
+
+	before := owners(t, snitchers)
+	owned := map[string]int{}
+	for _, owner := range before {
+		owned[owner]++
+	}
+	for _, gs := range snitchers {
+		if owned[gs.Name()] == 0 {
+			t.Errorf("Member %s owns no keys", gs.Name())
+		}
+	}
+
+	// every member computes the same assignments
+	for _, gs := range snitchers {
+		assignments, err := gs.ClusterAssignments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(assignments) != gossipTestKeys {
+			t.Fatalf("Member %s has %d assignments, expected %d", gs.Name(), len(assignments), gossipTestKeys)
+		}
+		for _, assignment := range assignments {
+			if assignment.ClientId != before[assignment.Key] {
+				t.Errorf("Member %s assigns %s to %s, expected %s", gs.Name(), assignment.Key, assignment.ClientId,
+					before[assignment.Key])
+			}
+			if assignment.Local != (assignment.ClientId == gs.Name()) {
+				t.Errorf("Member %s marks assignment of %s to %s as local", gs.Name(), assignment.Key,
+					assignment.ClientId)
+			}
+		}
+	}
+
+	leaving := snitchers[2]
+	leaving.Close()
+	remaining := snitchers[:2]
+	waitForMembers(t, remaining, 2)
+
+	after := owners(t, remaining)
+	for key, owner := range before {
+		if leaving.CheckOwnership(key) {
+			t.Errorf("Key %s is still owned by the member that left", key)
+		}
+		// only the keys of the member that left move
+		if owner != leaving.Name() && after[key] != owner {
+			t.Errorf("Key %s moved from %s to %s", key, owner, after[key])
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"sort"
 )
 
 func newUUID() (string, error) {
@@ -18,3 +19,9 @@ func newUUID() (string, error) {
 	uuid[6] = uuid[6]&^0xf0 | 0x40
 	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
 }
+
+func sortAssignments(assignments []*Assignment) {
+	sort.Slice(assignments, func(i, j int) bool {
+		return assignments[i].Key.String() < assignments[j].Key.String()
+	})
+}
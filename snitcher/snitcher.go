@@ -1,13 +1,52 @@
 package snitcher
 
 import (
+	"context"
+	"errors"
 	"log"
 	"os"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
 )
 
 var Logger = log.New(os.Stderr, "", log.LstdFlags)
 
+var ErrStoreNotListable = errors.New("Store can't list claims")
+
 type Snitcher interface {
-	RegisterKey(key string)
-	CheckOwnership(key string) bool
+	RegisterKey(key shardkey.ShardKey)
+	// UnregisterKey retires a key that won't be consumed anymore, e.g. a shard that ended or was deleted. The key isn't
+	// owned afterwards and doesn't count toward the snitcher's load.
+	UnregisterKey(key shardkey.ShardKey)
+	CheckOwnership(key shardkey.ShardKey) bool
+}
+
+// Drainer is a Snitcher that can give up its keys before shutting down so other snitchers take them over immediately
+// instead of after its claims expire. The snitcher doesn't own any keys after draining.
+type Drainer interface {
+	Snitcher
+	Drain(ctx context.Context) error
+}
+
+// Assignment is the owner of a key as seen by a snitcher.
+type Assignment struct {
+	Key      shardkey.ShardKey
+	ClientId string
+	Hostname string
+	// Weight is the load the owner holds before the key, Weight+Cost of its last key is the owner's total load.
+	Weight    float64
+	Cost      float64
+	Heartbeat time.Time
+	// Local is set when the key is owned by the snitcher that returned the assignment.
+	Local bool
+}
+
+// Inspector is a Snitcher that can show who owns which keys, e.g. to diagnose imbalance.
+type Inspector interface {
+	Snitcher
+	// Assignments returns the owners of the keys registered with this snitcher. Unowned keys have no ClientId.
+	Assignments() ([]*Assignment, error)
+	// ClusterAssignments returns the owners of all keys of the client group.
+	ClusterAssignments() ([]*Assignment, error)
 }
@@ -0,0 +1,143 @@
+package snitcher
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+const (
+	OrdinalEnv  = "KCL_ORDINAL"
+	ReplicasEnv = "KCL_REPLICAS"
+)
+
+var (
+	ErrInvalidOrdinal  = errors.New("Invalid ordinal")
+	ErrInvalidReplicas = errors.New("Invalid replica count")
+)
+
+// StatefulSetSnitcher assigns keys to the pods of a Kubernetes StatefulSet with jump consistent hashing over the pod's
+// ordinal and the number of replicas, without any store. When the replica count changes only the keys of the added or
+// removed pods move. Pods still running with the old count during a rolling update may consider the same key theirs as
+// an updated pod, the locker keeps them from reading it at the same time until the old pod is replaced.
+type StatefulSetSnitcher struct {
+	ordinal  int
+	replicas int
+
+	keys map[shardkey.ShardKey]bool
+	mu   sync.RWMutex
+}
+
+// NewStatefulSetSnitcher creates the snitcher of the pod with the given ordinal. The ordinal has to be one of the
+// replicas, from 0 to replicas-1.
+func NewStatefulSetSnitcher(ordinal int, replicas int) (*StatefulSetSnitcher, error) {
+	if replicas < 1 {
+		return nil, ErrInvalidReplicas
+	}
+	if ordinal < 0 || ordinal >= replicas {
+		return nil, ErrInvalidOrdinal
+	}
+
+	return &StatefulSetSnitcher{
+		ordinal:  ordinal,
+		replicas: replicas,
+		keys:     map[shardkey.ShardKey]bool{},
+	}, nil
+}
+
+// NewStatefulSetSnitcherFromEnv reads the replica count from KCL_REPLICAS and the ordinal from KCL_ORDINAL or, when
+// it's not set, from the suffix of the pod's hostname (e.g. 3 of kcl-3).
+func NewStatefulSetSnitcherFromEnv() (*StatefulSetSnitcher, error) {
+	replicas, err := strconv.Atoi(os.Getenv(ReplicasEnv))
+	if err != nil {
+		return nil, ErrInvalidReplicas
+	}
+
+	ordinal, err := ordinalFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStatefulSetSnitcher(ordinal, replicas)
+}
+
+func ordinalFromEnv() (int, error) {
+	value := os.Getenv(OrdinalEnv)
+	if value == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return 0, err
+		}
+		value = hostname[strings.LastIndex(hostname, "-")+1:]
+	}
+
+	ordinal, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, ErrInvalidOrdinal
+	}
+	return ordinal, nil
+}
+
+func (ss *StatefulSetSnitcher) RegisterKey(key shardkey.ShardKey) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.keys[key] = true
+}
+
+func (ss *StatefulSetSnitcher) UnregisterKey(key shardkey.ShardKey) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	delete(ss.keys, key)
+}
+
+func (ss *StatefulSetSnitcher) CheckOwnership(key shardkey.ShardKey) bool {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	if !ss.keys[key] {
+		return false
+	}
+
+	return jumpHash(keyHash(key), ss.replicas) == ss.ordinal
+}
+
+// SetReplicas changes the replica count, e.g. when the StatefulSet was scaled without restarting the pod.
+func (ss *StatefulSetSnitcher) SetReplicas(replicas int) error {
+	if replicas < 1 {
+		return ErrInvalidReplicas
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.replicas != replicas {
+		Logger.Printf("Replicas changed from %d to %d", ss.replicas, replicas)
+	}
+	ss.replicas = replicas
+	return nil
+}
+
+func keyHash(key shardkey.ShardKey) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key.String()))
+	return h.Sum64()
+}
+
+// jumpHash is the jump consistent hash by Lamping and Veach, it maps key to one of buckets so that only 1/n of the keys
+// move when the n-th bucket is added.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
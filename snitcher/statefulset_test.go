@@ -0,0 +1,55 @@
+package snitcher
+
+import (
+	"testing"
+)
+
+func TestNewStatefulSetSnitcherValidatesOrdinal(t *testing.T) {
+	tests := []struct {
+		ordinal  int
+		replicas int
+		err      error
+	}{
+		{0, 1, nil},
+		{2, 3, nil},
+		{3, 3, ErrInvalidOrdinal},
+		{5, 3, ErrInvalidOrdinal},
+		{-1, 3, ErrInvalidOrdinal},
+		{0, 0, ErrInvalidReplicas},
+	}
+
+	for _, test := range tests {
+		_, err := NewStatefulSetSnitcher(test.ordinal, test.replicas)
+		if err != test.err {
+			t.Errorf("Ordinal %d of %d replicas: got %v, expected %v", test.ordinal, test.replicas, err, test.err)
+		}
+	}
+}
+
+func TestStatefulSetSnitchersOwnEveryKeyOnce(t *testing.T) {
+	const replicas = 3
+
+	snitchers := []*StatefulSetSnitcher{}
+	for ordinal := 0; ordinal < replicas; ordinal++ {
+		ss, err := NewStatefulSetSnitcher(ordinal, replicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snitchers = append(snitchers, ss)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := balancingTestKey(i)
+
+		owners := 0
+		for _, ss := range snitchers {
+			ss.RegisterKey(key)
+			if ss.CheckOwnership(key) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			t.Errorf("Key %s has %d owners", key, owners)
+		}
+	}
+}
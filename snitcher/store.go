@@ -0,0 +1,142 @@
+package snitcher
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+// Claim is the shared ownership state of a key.
+type Claim struct {
+	ClientId string
+	// Weight is the load the owner holds before the key in its order of keys.
+	Weight float64
+	// Cost is the load of the key as measured by its owner.
+	Cost float64
+	// Hostname is the host of the owner.
+	Hostname string
+	// Heartbeat is the time the claim was last written, it's set by the store.
+	Heartbeat time.Time
+	// Generation changes with every write, it's used to detect concurrent writes.
+	Generation uint32
+}
+
+// Store keeps the claims of all snitchers of a client group. Claims expire unless they are written again within the
+// store's TTL so keys of dead snitchers are freed.
+type Store interface {
+	// Get returns the claim of the key or nil if there is none.
+	Get(key shardkey.ShardKey) (*Claim, error)
+	// Put writes the claim if the stored claim is still current, which is nil when the key had no claim. It returns
+	// false when another snitcher wrote the claim in the meantime.
+	Put(key shardkey.ShardKey, claim *Claim, current *Claim) (bool, error)
+	// Delete removes the claim if it's still current. It returns false when another snitcher wrote the claim in the
+	// meantime.
+	Delete(key shardkey.ShardKey, current *Claim) (bool, error)
+}
+
+// ListableStore is a Store that can list the claims of all keys.
+type ListableStore interface {
+	Store
+	List() (map[shardkey.ShardKey]*Claim, error)
+}
+
+// MemoryStore is a Store kept in memory. Snitchers sharing it behave like snitchers of different processes, e.g. to
+// simulate several workers balancing shards in one process.
+type MemoryStore struct {
+	ttl time.Duration
+
+	claims map[shardkey.ShardKey]*memoryClaim
+	// generations are unique across keys so a claim that expired and was created again gets a new generation
+	generation uint32
+	claimsMu   sync.Mutex
+}
+
+type memoryClaim struct {
+	claim   Claim
+	expires time.Time
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:    ttl,
+		claims: map[shardkey.ShardKey]*memoryClaim{},
+	}
+}
+
+func (ms *MemoryStore) Get(key shardkey.ShardKey) (*Claim, error) {
+	ms.claimsMu.Lock()
+	defer ms.claimsMu.Unlock()
+
+	mc := ms.current(key)
+	if mc == nil {
+		return nil, nil
+	}
+
+	claim := mc.claim
+	return &claim, nil
+}
+
+func (ms *MemoryStore) Put(key shardkey.ShardKey, claim *Claim, current *Claim) (bool, error) {
+	ms.claimsMu.Lock()
+	defer ms.claimsMu.Unlock()
+
+	mc := ms.current(key)
+	if (mc == nil) != (current == nil) || mc != nil && mc.claim.Generation != current.Generation {
+		return false, nil
+	}
+
+	ms.generation++
+	written := *claim
+	written.Generation = ms.generation
+	written.Heartbeat = time.Now()
+
+	ms.claims[key] = &memoryClaim{
+		claim:   written,
+		expires: time.Now().Add(ms.ttl),
+	}
+	return true, nil
+}
+
+func (ms *MemoryStore) current(key shardkey.ShardKey) *memoryClaim {
+	mc, ok := ms.claims[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(mc.expires) {
+		delete(ms.claims, key)
+		return nil
+	}
+	return mc
+}
+
+func (ms *MemoryStore) Delete(key shardkey.ShardKey, current *Claim) (bool, error) {
+	ms.claimsMu.Lock()
+	defer ms.claimsMu.Unlock()
+
+	mc := ms.current(key)
+	if mc == nil || mc.claim.Generation != current.Generation {
+		return false, nil
+	}
+
+	delete(ms.claims, key)
+	return true, nil
+}
+
+func (ms *MemoryStore) List() (map[shardkey.ShardKey]*Claim, error) {
+	ms.claimsMu.Lock()
+	defer ms.claimsMu.Unlock()
+
+	claims := map[shardkey.ShardKey]*Claim{}
+	for key := range ms.claims {
+		mc := ms.current(key)
+		if mc == nil {
+			continue
+		}
+
+		claim := mc.claim
+		claims[key] = &claim
+	}
+	return claims, nil
+}
@@ -0,0 +1,145 @@
+package snitcher
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+const (
+	defaultLoadWindow = time.Minute
+	// a shard reading this many bytes per second costs as much as one more idle shard
+	defaultBytesPerUnit = 256 * 1024
+)
+
+// BalancingStrategy decides how keys are spread over snitchers. Every snitcher claims its keys in a random order with
+// the load it owns before each key as the weight. A key owned by another snitcher is taken over when the load of the
+// snitcher including the key stays at or below the owner's weight, so load moves from busy to idle snitchers. All
+// snitchers of a client group have to use the same strategy.
+type BalancingStrategy interface {
+	// Cost returns the load a key adds to its owner. The cost of keys owned by other snitchers is the cost their owner
+	// published.
+	Cost(key shardkey.ShardKey) float64
+	// CanOwn reports whether a snitcher that owns owned keys may own one more.
+	CanOwn(owned int) bool
+}
+
+// LoadObserver is a strategy that measures the load of keys, e.g. from the records a reader reads.
+type LoadObserver interface {
+	Observe(key shardkey.ShardKey, bytes int)
+}
+
+// EvenStrategy spreads keys so every snitcher owns the same number of them.
+type EvenStrategy struct{}
+
+func NewEvenStrategy() *EvenStrategy {
+	return &EvenStrategy{}
+}
+
+func (es *EvenStrategy) Cost(key shardkey.ShardKey) float64 {
+	return 1
+}
+
+func (es *EvenStrategy) CanOwn(owned int) bool {
+	return true
+}
+
+// ThroughputStrategy weights keys by the bytes read from them so hot shards are spread over snitchers. A key costs 1
+// plus its rate in bytesPerUnit per second. Rates are computed over the last complete window, or over the current one
+// until the first window completes.
+type ThroughputStrategy struct {
+	window       time.Duration
+	bytesPerUnit float64
+
+	previous     map[shardkey.ShardKey]int64
+	current      map[shardkey.ShardKey]int64
+	currentStart time.Time
+	mu           sync.Mutex
+}
+
+func NewThroughputStrategy() *ThroughputStrategy {
+	return NewThroughputStrategyWithParameters(defaultLoadWindow, defaultBytesPerUnit)
+}
+
+func NewThroughputStrategyWithParameters(window time.Duration, bytesPerUnit float64) *ThroughputStrategy {
+	return &ThroughputStrategy{
+		window:       window,
+		bytesPerUnit: bytesPerUnit,
+		current:      map[shardkey.ShardKey]int64{},
+		currentStart: time.Now(),
+	}
+}
+
+func (ts *ThroughputStrategy) Observe(key shardkey.ShardKey, bytes int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.rotate()
+	ts.current[key] += int64(bytes)
+}
+
+func (ts *ThroughputStrategy) Cost(key shardkey.ShardKey) float64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.rotate()
+
+	bytes, elapsed := ts.current[key], time.Since(ts.currentStart)
+	if ts.previous != nil {
+		bytes, elapsed = ts.previous[key], ts.window
+	}
+	if elapsed <= 0 {
+		return 1
+	}
+
+	return 1 + float64(bytes)/elapsed.Seconds()/ts.bytesPerUnit
+}
+
+func (ts *ThroughputStrategy) CanOwn(owned int) bool {
+	return true
+}
+
+func (ts *ThroughputStrategy) rotate() {
+	now := time.Now()
+	if now.Sub(ts.currentStart) < ts.window {
+		return
+	}
+
+	// a gap of more than a window without observations leaves an empty previous window
+	if now.Sub(ts.currentStart) >= 2*ts.window {
+		ts.current = map[shardkey.ShardKey]int64{}
+	}
+
+	ts.previous = ts.current
+	ts.current = map[shardkey.ShardKey]int64{}
+	ts.currentStart = now
+}
+
+// MaxShardsStrategy caps the number of keys a snitcher owns and balances them with another strategy. Keys over the cap
+// are left to other snitchers.
+type MaxShardsStrategy struct {
+	strategy  BalancingStrategy
+	maxShards int
+}
+
+func NewMaxShardsStrategy(strategy BalancingStrategy, maxShards int) *MaxShardsStrategy {
+	return &MaxShardsStrategy{
+		strategy:  strategy,
+		maxShards: maxShards,
+	}
+}
+
+func (ms *MaxShardsStrategy) Cost(key shardkey.ShardKey) float64 {
+	return ms.strategy.Cost(key)
+}
+
+func (ms *MaxShardsStrategy) CanOwn(owned int) bool {
+	return owned < ms.maxShards && ms.strategy.CanOwn(owned)
+}
+
+func (ms *MaxShardsStrategy) Observe(key shardkey.ShardKey, bytes int) {
+	if observer, ok := ms.strategy.(LoadObserver); ok {
+		observer.Observe(key, bytes)
+	}
+}
@@ -0,0 +1,212 @@
+package kcl
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/matijavizintin/go-kcl/spill"
+)
+
+const (
+	spillReplayInterval    = time.Second
+	spillReplayMaxInterval = time.Minute
+	spillReplayBatch       = 500
+	// size limit of a PutRecords request, data and partition keys included
+	spillReplayBatchBytes = 5 * 1024 * 1024
+)
+
+// errors that will not go away by retrying later so records failing with them are returned instead of spilled
+var fatalPutErrors = map[string]bool{
+	kinesis.ErrCodeResourceNotFoundException: true,
+	kinesis.ErrCodeInvalidArgumentException:  true,
+	"ValidationException":                    true,
+	"AccessDeniedException":                  true,
+}
+
+// SetSpillQueue enables spilling of records that could not be put into the stream to a local disk queue. Once the
+// queue is not empty all new records are appended to it to preserve ordering and a background goroutine replays them
+// until PutRecords succeeds again. Records that remain in the queue are replayed after a restart when the same queue
+// is set again.
+func (c *Client) SetSpillQueue(queue *spill.Queue) {
+	if c.spillStop != nil {
+		close(c.spillStop)
+		c.spillStop = nil
+	}
+
+	c.spill = queue
+	if queue != nil {
+		c.spillStop = make(chan struct{})
+		go c.replaySpill(queue, c.spillStop)
+	}
+}
+
+func (c *Client) putRecordSpilled(streamName, partitionKey string, record []byte) error {
+	if c.spill.Len() == 0 {
+		out, err := c.kinesis.PutRecord(&kinesis.PutRecordInput{
+			Data:         record,
+			StreamName:   aws.String(streamName),
+			PartitionKey: aws.String(partitionKey),
+		})
+		if err == nil {
+			if c.sampler != nil {
+				c.sampler.Observe(streamName, aws.StringValue(out.ShardId), len(record))
+			}
+			return nil
+		}
+		if c.sampler != nil && isThrottled(err) {
+			c.sampler.ObserveThrottle(streamName)
+		}
+		if isFatalPutError(err) {
+			return err
+		}
+		Logger.Printf("Spilling record to %s. Err: %v", streamName, err)
+	}
+
+	return c.spill.Append([]*spill.Record{
+		{
+			StreamName:   streamName,
+			PartitionKey: partitionKey,
+			Data:         record,
+		},
+	})
+}
+
+func (c *Client) putRecordsSpilled(streamName string, records []*kinesis.PutRecordsRequestEntry) error {
+	if c.spill.Len() > 0 {
+		return c.spill.Append(toSpillRecords(streamName, records))
+	}
+
+	out, err := c.kinesis.PutRecords(&kinesis.PutRecordsInput{
+		Records:    records,
+		StreamName: aws.String(streamName),
+	})
+	if err != nil {
+		if isFatalPutError(err) {
+			return err
+		}
+		Logger.Printf("Spilling %d records to %s. Err: %v", len(records), streamName, err)
+		return c.spill.Append(toSpillRecords(streamName, records))
+	}
+
+	c.sampleRecords(streamName, records, out)
+	if aws.Int64Value(out.FailedRecordCount) == 0 {
+		return nil
+	}
+
+	// the later records of a partition key that failed are spilled too so the key's records are replayed in order,
+	// those that were put already end up in the stream twice
+	failedKeys := map[string]bool{}
+	spilled := []*kinesis.PutRecordsRequestEntry{}
+	for i, result := range out.Records {
+		partitionKey := aws.StringValue(records[i].PartitionKey)
+		if result.ErrorCode != nil {
+			failedKeys[partitionKey] = true
+		}
+		if failedKeys[partitionKey] {
+			spilled = append(spilled, records[i])
+		}
+	}
+	Logger.Printf("Spilling %d records of %d failed to %s", len(spilled), aws.Int64Value(out.FailedRecordCount), streamName)
+
+	return c.spill.Append(toSpillRecords(streamName, spilled))
+}
+
+func (c *Client) replaySpill(queue *spill.Queue, stop chan struct{}) {
+	interval := spillReplayInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+
+		for queue.Len() > 0 {
+			replayed, err := c.replaySpillBatch(queue)
+			if err != nil || replayed == 0 {
+				// nothing was accepted, back off until the stream takes records again
+				interval *= 2
+				if interval > spillReplayMaxInterval {
+					interval = spillReplayMaxInterval
+				}
+				if err != nil {
+					Logger.Printf("Spill replay failed, retrying in %v. Err: %v", interval, err)
+				}
+				break
+			}
+			interval = spillReplayInterval
+		}
+	}
+}
+
+// replaySpillBatch puts the oldest records of the queue that belong to the same stream and acknowledges the records
+// up to the first one that failed so the order is kept. Records are never dropped, when the whole request fails they
+// stay in the queue until the stream accepts them.
+func (c *Client) replaySpillBatch(queue *spill.Queue) (int, error) {
+	spilled, err := queue.Peek(spillReplayBatch)
+	if err != nil || len(spilled) == 0 {
+		return 0, err
+	}
+
+	streamName := spilled[0].StreamName
+	records := []*kinesis.PutRecordsRequestEntry{}
+	size := 0
+	for _, record := range spilled {
+		if record.StreamName != streamName {
+			break
+		}
+		size += len(record.Data) + len(record.PartitionKey)
+		if size > spillReplayBatchBytes && len(records) > 0 {
+			break
+		}
+
+		entry := &kinesis.PutRecordsRequestEntry{
+			Data:         record.Data,
+			PartitionKey: aws.String(record.PartitionKey),
+		}
+		if record.ExplicitHashKey != "" {
+			entry.ExplicitHashKey = aws.String(record.ExplicitHashKey)
+		}
+		records = append(records, entry)
+	}
+
+	out, err := c.kinesis.PutRecords(&kinesis.PutRecordsInput{
+		Records:    records,
+		StreamName: aws.String(streamName),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := len(records)
+	for i, result := range out.Records {
+		if result.ErrorCode != nil {
+			replayed = i
+			break
+		}
+	}
+
+	return replayed, queue.Ack(replayed)
+}
+
+func toSpillRecords(streamName string, records []*kinesis.PutRecordsRequestEntry) []*spill.Record {
+	spilled := make([]*spill.Record, 0, len(records))
+	for _, record := range records {
+		spilled = append(spilled, &spill.Record{
+			StreamName:      streamName,
+			PartitionKey:    aws.StringValue(record.PartitionKey),
+			ExplicitHashKey: aws.StringValue(record.ExplicitHashKey),
+			Data:            record.Data,
+		})
+	}
+
+	return spilled
+}
+
+func isFatalPutError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return fatalPutErrors[awsErr.Code()]
+	}
+	return false
+}
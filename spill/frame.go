@@ -0,0 +1,85 @@
+package spill
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// writeFrame writes the record as | payload length | crc32 of payload | payload | where the payload is a sequence of
+// uvarint length prefixed fields.
+func writeFrame(buf *bytes.Buffer, record *Record) {
+	payload := &bytes.Buffer{}
+	writeField(payload, []byte(record.StreamName))
+	writeField(payload, []byte(record.PartitionKey))
+	writeField(payload, []byte(record.ExplicitHashKey))
+	writeField(payload, record.Data)
+
+	header := make([]byte, frameHeader)
+	binary.BigEndian.PutUint32(header[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+
+	buf.Write(header)
+	buf.Write(payload.Bytes())
+}
+
+// readFrame returns the next record and the number of bytes it occupied. It returns io.EOF only at a frame boundary,
+// anything else that cannot be decoded is reported as errCorruptFrame.
+func readFrame(r *bufio.Reader) (*Record, int64, error) {
+	header := make([]byte, frameHeader)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	} else if err != nil || n != frameHeader {
+		return nil, 0, errCorruptFrame
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxFrameSize {
+		return nil, 0, errCorruptFrame
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, 0, errCorruptFrame
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorruptFrame
+	}
+
+	fields := make([][]byte, 4)
+	rest := payload
+	for i := range fields {
+		fields[i], rest, err = readField(rest)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	record := &Record{
+		StreamName:      string(fields[0]),
+		PartitionKey:    string(fields[1]),
+		ExplicitHashKey: string(fields[2]),
+		Data:            fields[3],
+	}
+	return record, int64(frameHeader + length), nil
+}
+
+func writeField(buf *bytes.Buffer, field []byte) {
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(field)))
+	buf.Write(length[:n])
+	buf.Write(field)
+}
+
+func readField(data []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return nil, nil, errCorruptFrame
+	}
+
+	return data[n : n+int(length)], data[n+int(length):], nil
+}
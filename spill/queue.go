@@ -0,0 +1,417 @@
+package spill
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	frameHeader   = 8
+	maxFrameSize  = 16 * 1024 * 1024
+)
+
+var (
+	ErrQueueFull   = errors.New("Spill queue full")
+	ErrQueueClosed = errors.New("Spill queue closed")
+	ErrInvalidAck  = errors.New("Acknowledged more records than peeked")
+
+	errCorruptFrame = errors.New("Corrupt spill frame")
+)
+
+var Logger = log.New(os.Stderr, "", log.LstdFlags)
+
+type Record struct {
+	StreamName      string
+	PartitionKey    string
+	ExplicitHashKey string
+	Data            []byte
+}
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+type position struct {
+	segment uint64
+	offset  int64
+}
+
+// Queue is a write-ahead queue of records persisted in segment files in a directory. Every record is framed with its
+// length and a crc32 checksum so torn writes are detected and truncated when the queue is reopened. The read position
+// is persisted in a cursor file and segments are deleted once all their records were acknowledged.
+type Queue struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu       sync.Mutex
+	segments []*segment
+	active   *os.File
+	size     int64
+	pending  int
+	cursor   position
+	peeked   []position
+	closed   bool
+}
+
+// Open opens or creates a queue in dir. Segment files are rolled when they reach segmentSize bytes and appends are
+// refused with ErrQueueFull when the queue would use more than maxSize bytes of disk.
+func Open(dir string, segmentSize, maxSize int64) (*Queue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+	}
+
+	err = q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Append persists records at the end of the queue. The call returns after the records were synced to disk.
+func (q *Queue) Append(records []*Record) error {
+	buf := &bytes.Buffer{}
+	for _, record := range records {
+		writeFrame(buf, record)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.size+int64(buf.Len()) > q.maxSize {
+		return ErrQueueFull
+	}
+
+	activeSegment := q.segments[len(q.segments)-1]
+	if activeSegment.size > 0 && activeSegment.size+int64(buf.Len()) > q.segmentSize {
+		err := q.roll()
+		if err != nil {
+			return err
+		}
+		activeSegment = q.segments[len(q.segments)-1]
+	}
+
+	// a failed write may leave a partial frame, later appends must not land behind it
+	_, err := q.active.Write(buf.Bytes())
+	if err == nil {
+		err = q.active.Sync()
+	}
+	if err != nil {
+		q.truncate(activeSegment)
+		return err
+	}
+
+	activeSegment.size += int64(buf.Len())
+	q.size += int64(buf.Len())
+	q.pending += len(records)
+	return nil
+}
+
+// Peek returns up to max oldest records without removing them from the queue. Records are removed by calling Ack.
+func (q *Queue) Peek(max int) ([]*Record, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	records := []*Record{}
+	q.peeked = q.peeked[:0]
+
+	pos := q.cursor
+	for _, seg := range q.segments {
+		if len(records) >= max {
+			break
+		}
+		if seg.id < pos.segment {
+			continue
+		}
+		if seg.id > pos.segment {
+			pos = position{segment: seg.id}
+		}
+		if pos.offset >= seg.size {
+			continue
+		}
+
+		f, err := os.Open(q.segmentPath(seg.id))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = f.Seek(pos.offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		r := bufio.NewReader(io.LimitReader(f, seg.size-pos.offset))
+		for len(records) < max {
+			record, n, err := readFrame(r)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return nil, err
+			}
+
+			pos.offset += n
+			records = append(records, record)
+			q.peeked = append(q.peeked, pos)
+		}
+		f.Close()
+	}
+
+	return records, nil
+}
+
+// Ack removes the first n records returned by the last Peek from the queue.
+func (q *Queue) Ack(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if n > len(q.peeked) {
+		return ErrInvalidAck
+	}
+
+	q.cursor = q.peeked[n-1]
+	q.peeked = q.peeked[:0]
+	q.pending -= n
+
+	// drop segments that were read completely unless they are still being written to
+	for len(q.segments) > 1 {
+		seg := q.segments[0]
+		if seg.id > q.cursor.segment || (seg.id == q.cursor.segment && q.cursor.offset < seg.size) {
+			break
+		}
+
+		err := os.Remove(q.segmentPath(seg.id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		q.size -= seg.size
+		q.segments = q.segments[1:]
+		if seg.id == q.cursor.segment {
+			q.cursor = position{segment: q.segments[0].id}
+		}
+	}
+
+	return q.writeCursor()
+}
+
+// Len returns the number of records that were not acknowledged yet.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.pending
+}
+
+// Size returns the number of bytes the queue uses on disk.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+
+	q.closed = true
+	return q.active.Close()
+}
+
+func (q *Queue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+
+		var id uint64
+		_, err := fmt.Sscanf(file.Name(), "%d"+segmentSuffix, &id)
+		if err != nil {
+			continue
+		}
+
+		q.segments = append(q.segments, &segment{id: id, size: file.Size()})
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].id < q.segments[j].id
+	})
+
+	err = q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	// remove segments that were acknowledged before a crash prevented their deletion
+	for len(q.segments) > 0 && q.segments[0].id < q.cursor.segment {
+		err := os.Remove(q.segmentPath(q.segments[0].id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, &segment{id: q.cursor.segment + 1})
+	}
+	if q.segments[0].id != q.cursor.segment {
+		q.cursor = position{segment: q.segments[0].id}
+	}
+
+	for _, seg := range q.segments {
+		err := q.recover(seg)
+		if err != nil {
+			return err
+		}
+		q.size += seg.size
+
+		if seg.id == q.cursor.segment && q.cursor.offset > seg.size {
+			q.cursor.offset = seg.size
+		}
+	}
+
+	activeSegment := q.segments[len(q.segments)-1]
+	q.active, err = os.OpenFile(q.segmentPath(activeSegment.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// recover counts the pending records in a segment and truncates it at the first frame that fails validation, which
+// is what a write interrupted by a crash leaves behind.
+func (q *Queue) recover(seg *segment) error {
+	f, err := os.OpenFile(q.segmentPath(seg.id), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		_, n, err := readFrame(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Logger.Printf("Spill segment %d truncated at offset %d: %v", seg.id, offset, err)
+			err = f.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if seg.id > q.cursor.segment || offset >= q.cursor.offset {
+			q.pending++
+		}
+		offset += n
+	}
+
+	seg.size = offset
+	return nil
+}
+
+// truncate drops what a failed append wrote to the active segment. When that fails too the next append goes to a new
+// segment and the leftover bytes are recovered like a torn write when the queue is reopened.
+func (q *Queue) truncate(activeSegment *segment) {
+	err := q.active.Truncate(activeSegment.size)
+	if err == nil {
+		return
+	}
+
+	Logger.Printf("Spill segment %d truncate failed: %v", activeSegment.id, err)
+	err = q.roll()
+	if err != nil {
+		Logger.Printf("Spill segment %d roll failed: %v", activeSegment.id, err)
+	}
+}
+
+func (q *Queue) roll() error {
+	err := q.active.Close()
+	if err != nil {
+		return err
+	}
+
+	seg := &segment{id: q.segments[len(q.segments)-1].id + 1}
+	q.active, err = os.OpenFile(q.segmentPath(seg.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.segments = append(q.segments, seg)
+	return nil
+}
+
+func (q *Queue) readCursor() error {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, cursorFile))
+	if os.IsNotExist(err) {
+		if len(q.segments) > 0 {
+			q.cursor = position{segment: q.segments[0].id}
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = fmt.Sscanf(string(data), "%d %d", &q.cursor.segment, &q.cursor.offset)
+	return err
+}
+
+// writeCursor replaces the cursor file atomically so a crash leaves either the old or the new position.
+func (q *Queue) writeCursor() error {
+	path := filepath.Join(q.dir, cursorFile)
+
+	err := ioutil.WriteFile(path+".tmp", []byte(fmt.Sprintf("%d %d\n", q.cursor.segment, q.cursor.offset)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016d%s", id, segmentSuffix))
+}
@@ -0,0 +1,205 @@
+package kcl
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/matijavizintin/go-kcl/spill"
+)
+
+// throttlingKinesis rejects the records whose data is in throttled, or whole PutRecords requests with err.
+type throttlingKinesis struct {
+	kinesisiface.KinesisAPI
+
+	throttled map[string]bool
+	err       error
+	requests  []*kinesis.PutRecordsInput
+}
+
+func (tk *throttlingKinesis) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	if tk.throttled[string(input.Data)] {
+		return nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "Rate exceeded", nil)
+	}
+	return &kinesis.PutRecordOutput{ShardId: aws.String("shard-0")}, nil
+}
+
+func (tk *throttlingKinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	tk.requests = append(tk.requests, input)
+	if tk.err != nil {
+		return nil, tk.err
+	}
+
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, record := range input.Records {
+		if tk.throttled[string(record.Data)] {
+			out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{
+				ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+			})
+			*out.FailedRecordCount++
+			continue
+		}
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ShardId: aws.String("shard-0")})
+	}
+	return out, nil
+}
+
+// newSpillingClient returns a client that spills to a queue in a temporary directory and a func that removes it.
+func newSpillingClient(t *testing.T, throttled ...string) (*Client, *spill.Queue, func()) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := spill.Open(dir, 1024*1024, 16*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk := &throttlingKinesis{throttled: map[string]bool{}}
+	for _, data := range throttled {
+		tk.throttled[data] = true
+	}
+
+	// the queue isn't replayed, SetSpillQueue would start doing that
+	client := &Client{kinesis: tk, spill: queue, sampler: NewTrafficSampler()}
+	return client, queue, func() {
+		queue.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func spilledData(t *testing.T, queue *spill.Queue) string {
+	records, err := queue.Peek(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []string{}
+	for _, record := range records {
+		data = append(data, string(record.Data))
+	}
+	return strings.Join(data, ",")
+}
+
+func TestPutRecordsSpillsLaterRecordsOfFailedKeys(t *testing.T) {
+	client, queue, cleanup := newSpillingClient(t, "a1")
+	defer cleanup()
+
+	records := []*kinesis.PutRecordsRequestEntry{}
+	for _, data := range []string{"a1", "b1", "a2", "c1", "b2", "a3"} {
+		records = append(records, &kinesis.PutRecordsRequestEntry{
+			Data:         []byte(data),
+			PartitionKey: aws.String(data[:1]),
+		})
+	}
+
+	err := client.PutRecords("stream", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spilled := spilledData(t, queue); spilled != "a1,a2,a3" {
+		t.Errorf("Spilled %s, expected a1,a2,a3", spilled)
+	}
+}
+
+func TestPutRecordSpilledObservesThrottle(t *testing.T) {
+	client, queue, cleanup := newSpillingClient(t, "a1")
+	defer cleanup()
+
+	err := client.PutRecord("stream", "a", []byte("a1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spilled := spilledData(t, queue); spilled != "a1" {
+		t.Errorf("Spilled %s, expected a1", spilled)
+	}
+
+	throughput, err := client.sampler.Throughput("stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throughput.WriteThrottled == 0 {
+		t.Error("Throttled record was not observed")
+	}
+}
+
+func TestReplaySpillBatchRespectsRequestSize(t *testing.T) {
+	client, queue, cleanup := newSpillingClient(t)
+	defer cleanup()
+
+	records := []*spill.Record{}
+	for i := 0; i < 12; i++ {
+		records = append(records, &spill.Record{StreamName: "stream", PartitionKey: "a", Data: make([]byte, 512*1024)})
+	}
+	err := queue.Append(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk := client.kinesis.(*throttlingKinesis)
+	for queue.Len() > 0 {
+		replayed, err := client.replaySpillBatch(queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replayed == 0 {
+			t.Fatal("No records were replayed")
+		}
+	}
+
+	for _, request := range tk.requests {
+		size := 0
+		for _, record := range request.Records {
+			size += len(record.Data) + len(aws.StringValue(record.PartitionKey))
+		}
+		if size > spillReplayBatchBytes {
+			t.Errorf("Request of %d records has %d bytes, expected at most %d", len(request.Records), size,
+				spillReplayBatchBytes)
+		}
+	}
+	if len(tk.requests) != 2 {
+		t.Errorf("Replayed in %d requests, expected 2", len(tk.requests))
+	}
+}
+
+func TestReplaySpillBatchKeepsRejectedRecords(t *testing.T) {
+	client, queue, cleanup := newSpillingClient(t)
+	defer cleanup()
+
+	err := queue.Append([]*spill.Record{
+		{StreamName: "stream", PartitionKey: "a", Data: []byte("a1")},
+		{StreamName: "stream", PartitionKey: "a", Data: []byte("a2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk := client.kinesis.(*throttlingKinesis)
+	for _, code := range []string{kinesis.ErrCodeResourceNotFoundException, "AccessDeniedException"} {
+		tk.err = awserr.New(code, "Rejected", nil)
+
+		replayed, err := client.replaySpillBatch(queue)
+		if err == nil || replayed != 0 {
+			t.Errorf("%s: replayed %d records with error %v, expected none and the error", code, replayed, err)
+		}
+		if spilled := spilledData(t, queue); spilled != "a1,a2" {
+			t.Errorf("%s: spilled %s, expected a1,a2", code, spilled)
+		}
+	}
+
+	tk.err = nil
+	replayed, err := client.replaySpillBatch(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 2 || queue.Len() != 0 {
+		t.Errorf("Replayed %d records and %d are left, expected 2 and none", replayed, queue.Len())
+	}
+}
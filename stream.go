@@ -0,0 +1,373 @@
+package kcl
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	streamWaitInterval = time.Second
+	streamWaitTimeout  = 10 * time.Minute
+)
+
+var (
+	ErrStreamNotActive   = errors.New("Stream not active")
+	ErrStreamDeleting    = errors.New("Stream is being deleted")
+	ErrMissingShardCount = errors.New("Missing shard count")
+)
+
+// StreamSpec is the desired state of a stream applied by EnsureStream. Zero values leave the corresponding setting as
+// it is, except ShardCount which is required to create a missing stream.
+type StreamSpec struct {
+	Name string
+
+	// ShardCount is the shard count of a created stream. The shard count of an existing stream is left alone so it
+	// doesn't undo the changes made by the Autoscaler, SplitShard or MergeShards.
+	ShardCount int
+
+	// RetentionHours is the data retention period, Kinesis accepts values from 24 to 8760.
+	RetentionHours int
+
+	// EncryptionKeyId is the KMS key used for server-side encryption. Nil leaves encryption as it is, an empty string
+	// disables it.
+	EncryptionKeyId *string
+
+	// Tags are added or updated, tags not listed here are left alone.
+	Tags map[string]string
+
+	// ShardLevelMetrics are the enhanced monitoring metrics that should be enabled, others are disabled. Nil leaves
+	// enhanced monitoring as it is.
+	ShardLevelMetrics []string
+}
+
+// WaitUntilActive blocks until the stream is ACTIVE. Streams are not writable while they are being created or updated.
+func (c *Client) WaitUntilActive(streamName string) error {
+	_, err := c.waitUntilActive(streamName)
+	return err
+}
+
+func (c *Client) IncreaseRetention(streamName string, hours int) error {
+	_, err := c.kinesis.IncreaseStreamRetentionPeriod(&kinesis.IncreaseStreamRetentionPeriodInput{
+		StreamName:           aws.String(streamName),
+		RetentionPeriodHours: aws.Int64(int64(hours)),
+	})
+	return err
+}
+
+func (c *Client) DecreaseRetention(streamName string, hours int) error {
+	_, err := c.kinesis.DecreaseStreamRetentionPeriod(&kinesis.DecreaseStreamRetentionPeriodInput{
+		StreamName:           aws.String(streamName),
+		RetentionPeriodHours: aws.Int64(int64(hours)),
+	})
+	return err
+}
+
+// EnableEncryption enables server-side encryption with the KMS key keyId, e.g. "alias/aws/kinesis".
+func (c *Client) EnableEncryption(streamName string, keyId string) error {
+	_, err := c.kinesis.StartStreamEncryption(&kinesis.StartStreamEncryptionInput{
+		StreamName:     aws.String(streamName),
+		EncryptionType: aws.String(kinesis.EncryptionTypeKms),
+		KeyId:          aws.String(keyId),
+	})
+	return err
+}
+
+func (c *Client) DisableEncryption(streamName string) error {
+	summary, err := c.streamSummary(streamName)
+	if err != nil {
+		return err
+	}
+
+	if aws.StringValue(summary.EncryptionType) != kinesis.EncryptionTypeKms {
+		return nil
+	}
+
+	_, err = c.kinesis.StopStreamEncryption(&kinesis.StopStreamEncryptionInput{
+		StreamName:     aws.String(streamName),
+		EncryptionType: aws.String(kinesis.EncryptionTypeKms),
+		KeyId:          summary.KeyId,
+	})
+	return err
+}
+
+func (c *Client) Tags(streamName string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	var exclusiveStartTagKey *string
+	for {
+		out, err := c.kinesis.ListTagsForStream(&kinesis.ListTagsForStreamInput{
+			StreamName:           aws.String(streamName),
+			ExclusiveStartTagKey: exclusiveStartTagKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range out.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+
+		if !aws.BoolValue(out.HasMoreTags) || len(out.Tags) == 0 {
+			return tags, nil
+		}
+		exclusiveStartTagKey = out.Tags[len(out.Tags)-1].Key
+	}
+}
+
+func (c *Client) AddTags(streamName string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	_, err := c.kinesis.AddTagsToStream(&kinesis.AddTagsToStreamInput{
+		StreamName: aws.String(streamName),
+		Tags:       aws.StringMap(tags),
+	})
+	return err
+}
+
+func (c *Client) RemoveTags(streamName string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := c.kinesis.RemoveTagsFromStream(&kinesis.RemoveTagsFromStreamInput{
+		StreamName: aws.String(streamName),
+		TagKeys:    aws.StringSlice(keys),
+	})
+	return err
+}
+
+// EnableEnhancedMonitoring enables shard-level metrics, e.g. kinesis.MetricsNameIncomingBytes.
+func (c *Client) EnableEnhancedMonitoring(streamName string, metrics []string) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	_, err := c.kinesis.EnableEnhancedMonitoring(&kinesis.EnableEnhancedMonitoringInput{
+		StreamName:        aws.String(streamName),
+		ShardLevelMetrics: aws.StringSlice(metrics),
+	})
+	return err
+}
+
+func (c *Client) DisableEnhancedMonitoring(streamName string, metrics []string) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	_, err := c.kinesis.DisableEnhancedMonitoring(&kinesis.DisableEnhancedMonitoringInput{
+		StreamName:        aws.String(streamName),
+		ShardLevelMetrics: aws.StringSlice(metrics),
+	})
+	return err
+}
+
+// EnsureStream creates the stream if it doesn't exist and brings it to the state described by spec, waiting for the
+// stream to become ACTIVE after every change. Calling it on a stream that already matches spec makes no changes. A
+// missing stream can't be created without a ShardCount, ErrMissingShardCount is returned then. The shard count of an
+// existing stream is never changed, use UpdateStream for that.
+func (c *Client) EnsureStream(spec *StreamSpec) error {
+	_, err := c.streamSummary(spec.Name)
+	if isResourceNotFound(err) {
+		if spec.ShardCount <= 0 {
+			return ErrMissingShardCount
+		}
+
+		err = c.CreateStream(spec.Name, spec.ShardCount)
+		if err != nil && !isResourceInUse(err) {
+			return err
+		}
+		Logger.Printf("Stream %s created", spec.Name)
+	} else if err != nil {
+		return err
+	}
+
+	summary, err := c.waitUntilActive(spec.Name)
+	if err != nil {
+		return err
+	}
+
+	currentRetention := int(aws.Int64Value(summary.RetentionPeriodHours))
+	if spec.RetentionHours > currentRetention {
+		err = c.applyStreamChange(spec.Name, func() error {
+			return c.IncreaseRetention(spec.Name, spec.RetentionHours)
+		})
+	} else if spec.RetentionHours > 0 && spec.RetentionHours < currentRetention {
+		err = c.applyStreamChange(spec.Name, func() error {
+			return c.DecreaseRetention(spec.Name, spec.RetentionHours)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.ensureEncryption(spec, summary)
+	if err != nil {
+		return err
+	}
+
+	err = c.ensureTags(spec)
+	if err != nil {
+		return err
+	}
+
+	return c.ensureEnhancedMonitoring(spec, summary)
+}
+
+func (c *Client) ensureEncryption(spec *StreamSpec, summary *kinesis.StreamDescriptionSummary) error {
+	if spec.EncryptionKeyId == nil {
+		return nil
+	}
+
+	encrypted := aws.StringValue(summary.EncryptionType) == kinesis.EncryptionTypeKms
+	keyId := *spec.EncryptionKeyId
+
+	if keyId == "" {
+		if !encrypted {
+			return nil
+		}
+		return c.applyStreamChange(spec.Name, func() error {
+			return c.DisableEncryption(spec.Name)
+		})
+	}
+
+	if encrypted && aws.StringValue(summary.KeyId) == keyId {
+		return nil
+	}
+	return c.applyStreamChange(spec.Name, func() error {
+		return c.EnableEncryption(spec.Name, keyId)
+	})
+}
+
+func (c *Client) ensureTags(spec *StreamSpec) error {
+	if len(spec.Tags) == 0 {
+		return nil
+	}
+
+	current, err := c.Tags(spec.Name)
+	if err != nil {
+		return err
+	}
+
+	changed := map[string]string{}
+	for key, value := range spec.Tags {
+		if currentValue, ok := current[key]; !ok || currentValue != value {
+			changed[key] = value
+		}
+	}
+
+	return c.AddTags(spec.Name, changed)
+}
+
+func (c *Client) ensureEnhancedMonitoring(spec *StreamSpec, summary *kinesis.StreamDescriptionSummary) error {
+	if spec.ShardLevelMetrics == nil {
+		return nil
+	}
+
+	current := map[string]bool{}
+	for _, metrics := range summary.EnhancedMonitoring {
+		for _, metric := range metrics.ShardLevelMetrics {
+			current[aws.StringValue(metric)] = true
+		}
+	}
+
+	desired := map[string]bool{}
+	enable := []string{}
+	for _, metric := range spec.ShardLevelMetrics {
+		desired[metric] = true
+		if !current[metric] {
+			enable = append(enable, metric)
+		}
+	}
+
+	disable := []string{}
+	for metric := range current {
+		if !desired[metric] {
+			disable = append(disable, metric)
+		}
+	}
+	sort.Strings(disable)
+
+	if len(enable) > 0 {
+		err := c.applyStreamChange(spec.Name, func() error {
+			return c.EnableEnhancedMonitoring(spec.Name, enable)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(disable) > 0 {
+		return c.applyStreamChange(spec.Name, func() error {
+			return c.DisableEnhancedMonitoring(spec.Name, disable)
+		})
+	}
+
+	return nil
+}
+
+// applyStreamChange runs an update and waits for the stream to settle since Kinesis rejects updates of streams that
+// are not ACTIVE.
+func (c *Client) applyStreamChange(streamName string, change func() error) error {
+	err := change()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.waitUntilActive(streamName)
+	return err
+}
+
+func (c *Client) waitUntilActive(streamName string) (*kinesis.StreamDescriptionSummary, error) {
+	deadline := time.Now().Add(streamWaitTimeout)
+	for {
+		summary, err := c.streamSummary(streamName)
+		if err != nil {
+			return nil, err
+		}
+
+		switch aws.StringValue(summary.StreamStatus) {
+		case kinesis.StreamStatusActive:
+			return summary, nil
+		case kinesis.StreamStatusDeleting:
+			return nil, ErrStreamDeleting
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrStreamNotActive
+		}
+		time.Sleep(streamWaitInterval)
+	}
+}
+
+func (c *Client) streamSummary(streamName string) (*kinesis.StreamDescriptionSummary, error) {
+	out, err := c.kinesis.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(streamName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.StreamDescriptionSummary, nil
+}
+
+func isResourceNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == kinesis.ErrCodeResourceNotFoundException
+}
+
+func isResourceInUse(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == kinesis.ErrCodeResourceInUseException
+}
+
+func isThrottled(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException
+}
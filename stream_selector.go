@@ -0,0 +1,65 @@
+package kcl
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const defaultStreamRefreshInterval = time.Minute
+
+// Record is a record read by a SharedReader together with the stream and shard it was read from.
+type Record struct {
+	*kinesis.Record
+	StreamName string
+	ShardId    string
+}
+
+// StreamSelector returns the streams a SharedReader consumes. It's called every time the reader looks for new shards.
+type StreamSelector func() ([]string, error)
+
+// StaticStreams selects a fixed set of streams.
+func StaticStreams(streamNames ...string) StreamSelector {
+	return func() ([]string, error) {
+		return streamNames, nil
+	}
+}
+
+// StreamsMatching selects the streams whose names match pattern. The stream list is refreshed every minute.
+func (c *Client) StreamsMatching(pattern *regexp.Regexp) StreamSelector {
+	return c.StreamsMatchingWithParameters(pattern, defaultStreamRefreshInterval)
+}
+
+// StreamsMatchingWithParameters selects the streams whose names match pattern. The stream list is refreshed every
+// refreshInterval since listing streams is limited to a few calls per second per account.
+func (c *Client) StreamsMatchingWithParameters(pattern *regexp.Regexp, refreshInterval time.Duration) StreamSelector {
+	var matching []string
+	var refreshed time.Time
+	mu := &sync.Mutex{}
+
+	return func() ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if matching != nil && time.Since(refreshed) < refreshInterval {
+			return matching, nil
+		}
+
+		streamNames, err := c.ListStreams()
+		if err != nil {
+			return nil, err
+		}
+
+		matching = []string{}
+		for _, streamName := range streamNames {
+			if pattern.MatchString(streamName) {
+				matching = append(matching, streamName)
+			}
+		}
+		refreshed = time.Now()
+
+		return matching, nil
+	}
+}
@@ -0,0 +1,145 @@
+package kcl
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// multiStreamKinesis serves several fake streams. Iterators are prefixed with the stream name.
+type multiStreamKinesis struct {
+	kinesisiface.KinesisAPI
+
+	streams   map[string]*fakeKinesis
+	listCalls int
+	mu        sync.Mutex
+}
+
+func (mk *multiStreamKinesis) addStream(streamName string, base int) {
+	fk := newFakeKinesis()
+	fk.putRecords(fk.addShard("shard-0"), base, 10, time.Now())
+
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+	mk.streams[streamName] = fk
+}
+
+func (mk *multiStreamKinesis) stream(streamName string) (*fakeKinesis, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	fk, ok := mk.streams[streamName]
+	if !ok {
+		return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream not found", nil)
+	}
+	return fk, nil
+}
+
+func (mk *multiStreamKinesis) ListStreams(input *kinesis.ListStreamsInput) (*kinesis.ListStreamsOutput, error) {
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+
+	mk.listCalls++
+	streamNames := []string{}
+	for streamName := range mk.streams {
+		streamNames = append(streamNames, streamName)
+	}
+	sort.Strings(streamNames)
+
+	return &kinesis.ListStreamsOutput{StreamNames: aws.StringSlice(streamNames), HasMoreStreams: aws.Bool(false)}, nil
+}
+
+func (mk *multiStreamKinesis) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	fk, err := mk.stream(aws.StringValue(input.StreamName))
+	if err != nil {
+		return nil, err
+	}
+	return fk.ListShards(input)
+}
+
+func (mk *multiStreamKinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	streamName := aws.StringValue(input.StreamName)
+	fk, err := mk.stream(streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := fk.GetShardIterator(input)
+	if err != nil {
+		return nil, err
+	}
+	out.ShardIterator = aws.String(streamName + "#" + aws.StringValue(out.ShardIterator))
+	return out, nil
+}
+
+func (mk *multiStreamKinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	parts := strings.SplitN(aws.StringValue(input.ShardIterator), "#", 2)
+	fk, err := mk.stream(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := fk.GetRecords(&kinesis.GetRecordsInput{Limit: input.Limit, ShardIterator: aws.String(parts[1])})
+	if err != nil {
+		return nil, err
+	}
+	if out.NextShardIterator != nil {
+		out.NextShardIterator = aws.String(parts[0] + "#" + aws.StringValue(out.NextShardIterator))
+	}
+	return out, nil
+}
+
+func TestMultiStreamReaderTagsRecordsOfMatchingStreams(t *testing.T) {
+	mk := &multiStreamKinesis{streams: map[string]*fakeKinesis{}}
+	mk.addStream("orders-a", 1000)
+	mk.addStream("orders-b", 2000)
+	mk.addStream("payments", 3000)
+
+	client := newTestClient(nil)
+	client.kinesis = mk
+	streams := client.StreamsMatchingWithParameters(regexp.MustCompile("^orders-"), 50*time.Millisecond)
+	reader, err := client.NewMultiStreamReaderWithParameters(streams, "client", time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bases := map[string]string{"orders-a": "1", "orders-b": "2", "orders-c": "4"}
+	read := map[string]int{}
+	created := false
+
+	records := reader.TaggedRecords()
+	for record := range records {
+		sequenceNumber := aws.StringValue(record.SequenceNumber)
+		if !strings.HasPrefix(sequenceNumber, bases[record.StreamName]) || record.ShardId != "shard-0" {
+			t.Errorf("Record %s was tagged with %s/%s", sequenceNumber, record.StreamName, record.ShardId)
+		}
+		read[record.StreamName]++
+
+		// a stream created later is picked up once the stream list is refreshed
+		if read["orders-a"] == 10 && read["orders-b"] == 10 && !created {
+			created = true
+			mk.addStream("orders-c", 4000)
+		}
+		if read["orders-c"] == 10 {
+			reader.Close()
+		}
+	}
+
+	if read["payments"] > 0 {
+		t.Errorf("Read %d records of a stream that doesn't match", read["payments"])
+	}
+
+	mk.mu.Lock()
+	defer mk.mu.Unlock()
+	if mk.listCalls < 2 {
+		t.Errorf("Streams were listed %d times, expected a refresh", mk.listCalls)
+	}
+}
@@ -0,0 +1,51 @@
+package kcl
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// missingStreamKinesis has no streams and records the streams that would be created.
+type missingStreamKinesis struct {
+	kinesisiface.KinesisAPI
+
+	created []*kinesis.CreateStreamInput
+}
+
+func (mk *missingStreamKinesis) DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream not found", nil)
+}
+
+func (mk *missingStreamKinesis) CreateStream(input *kinesis.CreateStreamInput) (*kinesis.CreateStreamOutput, error) {
+	mk.created = append(mk.created, input)
+	return &kinesis.CreateStreamOutput{}, nil
+}
+
+func TestEnsureStreamRequiresShardCountToCreate(t *testing.T) {
+	mk := &missingStreamKinesis{}
+	client := &Client{kinesis: mk}
+
+	err := client.EnsureStream(&StreamSpec{Name: "stream", RetentionHours: 48})
+	if err != ErrMissingShardCount {
+		t.Errorf("Got %v, expected %v", err, ErrMissingShardCount)
+	}
+	if len(mk.created) > 0 {
+		t.Error("Stream was created without a shard count")
+	}
+}
+
+func TestEnsureStreamKeepsShardCountOfExistingStream(t *testing.T) {
+	sk := &scalingKinesis{shards: 8}
+	client := &Client{kinesis: sk}
+
+	err := client.EnsureStream(&StreamSpec{Name: "stream", ShardCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sk.updates > 0 || sk.shards != 8 {
+		t.Errorf("Shard count updated to %d, expected to keep 8", sk.shards)
+	}
+}
@@ -0,0 +1,571 @@
+package kcl
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+var (
+	ErrMissingProcessorFactory = errors.New("Missing record processor factory")
+	ErrNothingToCheckpoint     = errors.New("No records to checkpoint")
+)
+
+type ShardInfo struct {
+	StreamName string
+	ShardId    string
+	ClientName string
+
+	ParentShardId         string
+	AdjacentParentShardId string
+
+	// Checkpoint is the sequence number processing resumes after, empty when the shard is read from TRIM_HORIZON
+	Checkpoint string
+}
+
+// RecordProcessorCheckpointer persists the progress of a record processor on its shard.
+type RecordProcessorCheckpointer interface {
+	// Checkpoint marks all records passed to the processor so far as processed.
+	Checkpoint() error
+	// CheckpointAt marks the records up to and including the one with sequenceNumber as processed.
+	CheckpointAt(sequenceNumber string) error
+}
+
+// RecordProcessor processes the records of a single shard. A worker creates one processor per shard it owns and
+// calls it from a single goroutine: Initialize first, then ProcessRecords for every batch and finally exactly one of
+// LeaseLost, ShardEnded or ShutdownRequested.
+type RecordProcessor interface {
+	Initialize(shard *ShardInfo) error
+	ProcessRecords(records []*kinesis.Record, checkpointer RecordProcessorCheckpointer) error
+	// LeaseLost is called when the shard was taken over by another worker or its lock was lost. Checkpointing is not
+	// possible anymore.
+	LeaseLost()
+	// ShardEnded is called when all records of a shard closed by resharding were processed.
+	ShardEnded(checkpointer RecordProcessorCheckpointer) error
+	// ShutdownRequested is called when the worker is shutting down and is the last chance to checkpoint.
+	ShutdownRequested(checkpointer RecordProcessorCheckpointer) error
+}
+
+type RecordProcessorFactory func(shard *ShardInfo) RecordProcessor
+
+// Worker consumes a stream shared with other workers of the same client name. It takes the shards the snitcher assigns
+// to it, locks them and drives a RecordProcessor per shard.
+type Worker struct {
+	client *Client
+
+	streamName         string
+	clientName         string
+	factory            RecordProcessorFactory
+	streamReadInterval time.Duration
+	readBatchSize      int
+	channelBufferSize  int
+
+	shards map[string]*shardWorker
+	// registered shards compete for ownership with the snitcher, ended shards were processed to their end and are
+	// remembered until they disappear from the stream
+	registered map[string]bool
+	ended      map[string]bool
+	shardsMu   sync.Mutex
+	wg         *sync.WaitGroup
+
+	stop   chan struct{}
+	closed bool
+	err    error
+}
+
+type shardWorker struct {
+	info      *ShardInfo
+	reader    *LockedReader
+	leaseLost bool
+	shutdown  bool
+	done      bool
+	ended     bool
+	mu        sync.Mutex
+}
+
+type processorCheckpointer struct {
+	reader *LockedReader
+	last   string
+}
+
+func (c *Client) NewWorker(streamName string, clientName string, factory RecordProcessorFactory) (*Worker, error) {
+	return c.NewWorkerWithParameters(streamName, clientName, factory, defaultReadInterval, defaultBatchSize, defaultChannelSize)
+}
+
+// NewWorkerWithParameters creates a worker whose shard readers use the given parameters. readBatchSize is also the
+// maximum number of records passed to a single ProcessRecords call.
+func (c *Client) NewWorkerWithParameters(streamName string, clientName string, factory RecordProcessorFactory, streamReadInterval time.Duration, readBatchSize int, channelBufferSize int) (*Worker, error) {
+	if c.distlock == nil {
+		return nil, ErrMissingLocker
+	}
+	if c.checkpoint == nil {
+		return nil, ErrMissingCheckpointer
+	}
+	if c.snitch == nil {
+		return nil, ErrMissingSnitcher
+	}
+	if factory == nil {
+		return nil, ErrMissingProcessorFactory
+	}
+
+	w := &Worker{
+		client:             c,
+		streamName:         streamName,
+		clientName:         clientName,
+		factory:            factory,
+		streamReadInterval: streamReadInterval,
+		readBatchSize:      readBatchSize,
+		channelBufferSize:  channelBufferSize,
+
+		shards:     map[string]*shardWorker{},
+		registered: map[string]bool{},
+		ended:      map[string]bool{},
+		wg:         &sync.WaitGroup{},
+		stop:       make(chan struct{}),
+	}
+
+	return w, nil
+}
+
+// Run discovers shards and processes the owned ones until Shutdown is called or discovery fails. It returns the error
+// that stopped the worker.
+func (w *Worker) Run() error {
+	ticker := time.NewTicker(streamConsumerUpdate)
+	defer ticker.Stop()
+
+	for {
+		err := w.updateShards()
+		if err != nil {
+			w.err = err
+			w.shutdownShards()
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			w.shutdownShards()
+			return w.err
+		}
+	}
+}
+
+// Shutdown stops the worker, calls ShutdownRequested on all processors and releases the shards once they return.
+func (w *Worker) Shutdown() {
+	w.shardsMu.Lock()
+	if w.closed {
+		w.shardsMu.Unlock()
+		return
+	}
+	w.closed = true
+	w.shardsMu.Unlock()
+
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *Worker) updateShards() error {
+	shards, err := w.client.ListShards(w.streamName, nil)
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+
+	// Kinesis, the locker and the checkpointer are called without shardsMu so Shutdown doesn't wait for them
+	startable := w.assignShards(shards, listed)
+
+	drained := map[string]bool{}
+	for _, ss := range startable {
+		// a child shard is processed after its parents so the records of a partition key are processed in order
+		processed, err := w.parentsDrained(ss.parents, drained)
+		if err != nil {
+			return err
+		}
+		if !processed {
+			continue
+		}
+
+		err = w.startShard(ss.shard)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startableShard is an owned shard that isn't processed yet, parents are those that may still have records left.
+type startableShard struct {
+	shard   *kinesis.Shard
+	parents []string
+}
+
+// assignShards updates the registered and ended shards, stops the shards that are not owned anymore and returns the
+// owned ones that can be started.
+func (w *Worker) assignShards(shards []*kinesis.Shard, listed map[string]bool) []*startableShard {
+	w.shardsMu.Lock()
+	defer w.shardsMu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	w.removeUnlisted(listed)
+
+	startable := []*startableShard{}
+	for _, shard := range shards {
+		shardId := aws.StringValue(shard.ShardId)
+		key := w.client.shardKey(w.streamName, shardId, w.clientName)
+		sw := w.shards[shardId]
+
+		if w.ended[shardId] {
+			continue
+		}
+
+		if sw != nil && sw.isDone() {
+			delete(w.shards, shardId)
+
+			// closed shards stay in the stream until their records expire but there is nothing left to process
+			if sw.hasEnded() {
+				w.ended[shardId] = true
+				delete(w.registered, shardId)
+				w.client.snitch.UnregisterKey(key)
+				continue
+			}
+			sw = nil
+		}
+
+		w.client.snitch.RegisterKey(key)
+		w.registered[shardId] = true
+
+		if !w.client.snitch.CheckOwnership(key) {
+			if sw != nil {
+				sw.stop(true)
+			}
+			continue
+		}
+
+		if sw != nil {
+			continue
+		}
+
+		startable = append(startable, &startableShard{
+			shard:   shard,
+			parents: w.unprocessedParents(shard, listed),
+		})
+	}
+
+	return startable
+}
+
+// removeUnlisted forgets the shards that disappeared from the stream, e.g. closed shards whose records expired. It
+// must be called with shardsMu held.
+func (w *Worker) removeUnlisted(listed map[string]bool) {
+	for shardId, sw := range w.shards {
+		if listed[shardId] {
+			continue
+		}
+
+		sw.stop(false)
+		if sw.isDone() {
+			delete(w.shards, shardId)
+		}
+	}
+
+	for shardId := range w.registered {
+		if !listed[shardId] {
+			w.client.snitch.UnregisterKey(w.client.shardKey(w.streamName, shardId, w.clientName))
+			delete(w.registered, shardId)
+		}
+	}
+
+	for shardId := range w.ended {
+		if !listed[shardId] {
+			delete(w.ended, shardId)
+		}
+	}
+}
+
+// unprocessedParents returns the parents of the shard that this worker doesn't know to be processed to their end.
+// Parents that disappeared from the stream have nothing left to process. It must be called with shardsMu held.
+func (w *Worker) unprocessedParents(shard *kinesis.Shard, listed map[string]bool) []string {
+	parents := []string{}
+	for _, parentId := range []string{aws.StringValue(shard.ParentShardId), aws.StringValue(shard.AdjacentParentShardId)} {
+		if parentId == "" || !listed[parentId] || w.ended[parentId] {
+			continue
+		}
+		if sw := w.shards[parentId]; sw != nil && sw.hasEnded() {
+			continue
+		}
+		parents = append(parents, parentId)
+	}
+
+	return parents
+}
+
+// parentsDrained reports whether the parents were processed to their end by any worker of the group. Drained shards
+// are remembered in drained so shards with a common parent don't read it again.
+func (w *Worker) parentsDrained(parents []string, drained map[string]bool) (bool, error) {
+	for _, parentId := range parents {
+		if drained[parentId] {
+			continue
+		}
+
+		ok, err := w.shardDrained(parentId)
+		if err != nil || !ok {
+			return false, err
+		}
+		drained[parentId] = true
+	}
+
+	return true, nil
+}
+
+// startShard locks the shard and starts processing it unless the worker was shut down in the meantime.
+func (w *Worker) startShard(shard *kinesis.Shard) error {
+	shardId := aws.StringValue(shard.ShardId)
+
+	reader, err := w.client.NewLockedReaderWithParameters(w.streamName, shardId, w.clientName, w.streamReadInterval, w.readBatchSize, w.channelBufferSize)
+	if err == ErrShardLocked {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	checkpoint, err := w.client.checkpoint.GetCheckpoint(w.client.shardKey(w.streamName, shardId, w.clientName))
+	if err != nil {
+		reader.Release()
+		return err
+	}
+
+	sw := &shardWorker{
+		info: &ShardInfo{
+			StreamName:            w.streamName,
+			ShardId:               shardId,
+			ClientName:            w.clientName,
+			ParentShardId:         aws.StringValue(shard.ParentShardId),
+			AdjacentParentShardId: aws.StringValue(shard.AdjacentParentShardId),
+			Checkpoint:            checkpoint,
+		},
+		reader: reader,
+	}
+
+	w.shardsMu.Lock()
+	started := !w.closed
+	if started {
+		w.shards[shardId] = sw
+		w.wg.Add(1)
+		go w.processShard(sw)
+	}
+	w.shardsMu.Unlock()
+
+	if !started {
+		return reader.Release()
+	}
+	return nil
+}
+
+// shardDrained reports whether a shard was closed and nothing is left to read after the group's checkpoint. Pages may
+// be empty before the next record so they are followed until a record or the tip of the shard is reached.
+func (w *Worker) shardDrained(shardId string) (bool, error) {
+	checkpoint, err := w.client.checkpoint.GetCheckpoint(w.client.shardKey(w.streamName, shardId, w.clientName))
+	if err != nil {
+		return false, err
+	}
+
+	input, err := shardIteratorInput(w.streamName, shardId, checkpoint)
+	if err != nil {
+		return false, err
+	}
+
+	iterator, err := w.client.kinesis.GetShardIterator(input)
+	if err != nil {
+		return false, err
+	}
+
+	shardIterator := iterator.ShardIterator
+	for i := 0; i < maxTimestampReads && shardIterator != nil; i++ {
+		out, err := w.client.kinesis.GetRecords(&kinesis.GetRecordsInput{
+			Limit:         aws.Int64(1),
+			ShardIterator: shardIterator,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if len(out.Records) > 0 {
+			return false, nil
+		}
+		shardIterator = out.NextShardIterator
+		if aws.Int64Value(out.MillisBehindLatest) == 0 {
+			break
+		}
+	}
+
+	// a closed shard has no next iterator once all of its records were read
+	return shardIterator == nil, nil
+}
+
+func (w *Worker) shutdownShards() {
+	w.shardsMu.Lock()
+	for _, sw := range w.shards {
+		sw.stop(false)
+	}
+	w.shardsMu.Unlock()
+
+	w.wg.Wait()
+}
+
+func (w *Worker) processShard(sw *shardWorker) {
+	defer w.wg.Done()
+	defer sw.finish()
+
+	Logger.Printf("Processing shard: %s", sw.info.ShardId)
+
+	processor := w.factory(sw.info)
+	checkpointer := &processorCheckpointer{
+		reader: sw.reader,
+	}
+
+	records := sw.reader.Records()
+
+	err := processor.Initialize(sw.info)
+	initialized := err == nil
+	if err != nil {
+		Logger.Printf("Initializing processor of shard %s failed. Err: %v", sw.info.ShardId, err)
+		sw.stop(false)
+	}
+
+	// after a failure the remaining records are drained without processing until the reader is closed
+	for {
+		batch, ok := nextBatch(records, w.readBatchSize)
+		if len(batch) > 0 && err == nil {
+			processed := checkpointer.last
+			checkpointer.last = aws.StringValue(batch[len(batch)-1].SequenceNumber)
+
+			err = processor.ProcessRecords(batch, checkpointer)
+			if err != nil {
+				Logger.Printf("Processing records of shard %s failed. Err: %v", sw.info.ShardId, err)
+				checkpointer.last = processed
+				sw.stop(false)
+			}
+		}
+		if !ok {
+			break
+		}
+	}
+
+	readErr := sw.reader.Close()
+	if readErr != nil {
+		Logger.Printf("Reading shard %s failed. Err: %v", sw.info.ShardId, readErr)
+	}
+
+	sw.mu.Lock()
+	leaseLost, shutdown := sw.leaseLost || sw.reader.IsLockLost(), sw.shutdown
+	sw.mu.Unlock()
+
+	switch {
+	case !initialized:
+		err = nil
+	case leaseLost:
+		processor.LeaseLost()
+		err = nil
+	case sw.reader.IsShardEnded() && !shutdown:
+		err = processor.ShardEnded(checkpointer)
+		if err == nil {
+			sw.mu.Lock()
+			sw.ended = true
+			sw.mu.Unlock()
+		}
+	default:
+		err = processor.ShutdownRequested(checkpointer)
+	}
+	if err != nil {
+		Logger.Printf("Shutting down processor of shard %s failed. Err: %v", sw.info.ShardId, err)
+	}
+
+	err = sw.reader.Release()
+	if err != nil {
+		Logger.Printf("Releasing shard %s failed. Err: %v", sw.info.ShardId, err)
+	}
+
+	Logger.Printf("Stopped processing shard: %s", sw.info.ShardId)
+}
+
+// stop closes the reader so the processor receives the remaining records and then its final lifecycle call.
+func (sw *shardWorker) stop(leaseLost bool) {
+	sw.mu.Lock()
+	if sw.done || sw.leaseLost || sw.shutdown {
+		sw.mu.Unlock()
+		return
+	}
+	sw.leaseLost = leaseLost
+	sw.shutdown = !leaseLost
+	sw.mu.Unlock()
+
+	go sw.reader.Close()
+}
+
+func (sw *shardWorker) finish() {
+	sw.mu.Lock()
+	sw.done = true
+	sw.mu.Unlock()
+}
+
+func (sw *shardWorker) isDone() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return sw.done
+}
+
+// hasEnded reports whether ShardEnded was called and succeeded, a failed one is retried by a new processor.
+func (sw *shardWorker) hasEnded() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return sw.ended
+}
+
+func (pc *processorCheckpointer) Checkpoint() error {
+	if pc.last == "" {
+		return ErrNothingToCheckpoint
+	}
+
+	return pc.CheckpointAt(pc.last)
+}
+
+func (pc *processorCheckpointer) CheckpointAt(sequenceNumber string) error {
+	return pc.reader.UpdateCheckpointTo(sequenceNumber)
+}
+
+// nextBatch blocks until a record is available and then takes up to size records that are already buffered. It
+// returns false once the channel is closed.
+func nextBatch(records <-chan *kinesis.Record, size int) ([]*kinesis.Record, bool) {
+	record, ok := <-records
+	if !ok {
+		return nil, false
+	}
+
+	batch := []*kinesis.Record{record}
+	for len(batch) < size {
+		select {
+		case record, ok := <-records:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, record)
+		default:
+			return batch, true
+		}
+	}
+
+	return batch, true
+}
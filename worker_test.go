@@ -0,0 +1,251 @@
+package kcl
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/matijavizintin/go-kcl/shardkey"
+)
+
+type checkpointingProcessor struct {
+	processed int
+	mu        *sync.Mutex
+}
+
+func (p *checkpointingProcessor) Initialize(shard *ShardInfo) error {
+	return nil
+}
+
+func (p *checkpointingProcessor) ProcessRecords(records []*kinesis.Record, checkpointer RecordProcessorCheckpointer) error {
+	// give the reader time to fill the channel buffer and block on it
+	time.Sleep(10 * time.Millisecond)
+
+	p.mu.Lock()
+	p.processed += len(records)
+	p.mu.Unlock()
+
+	return checkpointer.Checkpoint()
+}
+
+func (p *checkpointingProcessor) LeaseLost() {}
+
+func (p *checkpointingProcessor) ShardEnded(checkpointer RecordProcessorCheckpointer) error {
+	return nil
+}
+
+func (p *checkpointingProcessor) ShutdownRequested(checkpointer RecordProcessorCheckpointer) error {
+	return nil
+}
+
+func TestWorkerCheckpointsWhileReaderIsAhead(t *testing.T) {
+	fk := newFakeKinesis()
+	shard := fk.addShard("shard-0")
+	fk.putRecords(shard, 1000, 5*defaultBatchSize, time.Now())
+
+	client := newTestClient(fk)
+	processor := &checkpointingProcessor{mu: &sync.Mutex{}}
+	worker, err := client.NewWorkerWithParameters("stream", "client", func(shard *ShardInfo) RecordProcessor {
+		return processor
+	}, time.Millisecond, defaultBatchSize, defaultChannelSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go worker.Run()
+
+	key := shardkey.New("", "stream", "shard-0", "client")
+	last := aws.StringValue(shard.records[len(shard.records)-1].SequenceNumber)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		checkpoint, _ := client.checkpoint.GetCheckpoint(key)
+		if checkpoint == last {
+			worker.Shutdown()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the worker is left running, shutting it down would block on the deadlocked reader
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	t.Fatalf("Checkpoint didn't reach %s, %d records processed", last, processor.processed)
+}
+
+// recordingProcessor logs the lifecycle calls of the processors of all shards in the order they happened.
+type recordingProcessor struct {
+	shardId string
+	events  *[]string
+	mu      *sync.Mutex
+}
+
+func (p *recordingProcessor) record(event string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	*p.events = append(*p.events, p.shardId+" "+event)
+}
+
+func (p *recordingProcessor) Initialize(shard *ShardInfo) error {
+	return nil
+}
+
+func (p *recordingProcessor) ProcessRecords(records []*kinesis.Record, checkpointer RecordProcessorCheckpointer) error {
+	p.record("records")
+	return checkpointer.Checkpoint()
+}
+
+func (p *recordingProcessor) LeaseLost() {}
+
+func (p *recordingProcessor) ShardEnded(checkpointer RecordProcessorCheckpointer) error {
+	p.record("ended")
+	return nil
+}
+
+func (p *recordingProcessor) ShutdownRequested(checkpointer RecordProcessorCheckpointer) error {
+	return nil
+}
+
+func TestWorkerProcessesChildAfterParentAndForgetsEndedShards(t *testing.T) {
+	fk := newFakeKinesis()
+	parent := fk.addShard("shard-0")
+	fk.putRecords(parent, 1000, 300, time.Now())
+	fk.closeShard(parent)
+	child := fk.addShard("shard-1", "shard-0")
+	fk.putRecords(child, 2000, 10, time.Now())
+
+	events := []string{}
+	mu := &sync.Mutex{}
+	client := newTestClient(fk)
+	worker, err := client.NewWorkerWithParameters("stream", "client", func(shard *ShardInfo) RecordProcessor {
+		return &recordingProcessor{shardId: shard.ShardId, events: &events, mu: mu}
+	}, time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go worker.Run()
+	defer worker.Shutdown()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(events) > 0 && events[len(events)-1] == "shard-1 records"
+	})
+
+	mu.Lock()
+	parentEnded := false
+	for _, event := range events {
+		switch event {
+		case "shard-0 ended":
+			parentEnded = true
+		case "shard-1 records":
+			if !parentEnded {
+				t.Error("Child shard was processed before its parent ended")
+			}
+		}
+	}
+	mu.Unlock()
+
+	waitFor(t, func() bool {
+		worker.shardsMu.Lock()
+		defer worker.shardsMu.Unlock()
+
+		return worker.shards["shard-0"] == nil && worker.ended["shard-0"] && !worker.registered["shard-0"]
+	})
+
+	fk.removeShard(parent)
+	waitFor(t, func() bool {
+		worker.shardsMu.Lock()
+		defer worker.shardsMu.Unlock()
+
+		return len(worker.ended) == 0 && len(worker.shards) == 1 && len(worker.registered) == 1
+	})
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stallingKinesis blocks the first GetShardIterator call of a shard until release is closed.
+type stallingKinesis struct {
+	*fakeKinesis
+
+	shardId string
+	stalled chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (sk *stallingKinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	if aws.StringValue(input.ShardId) == sk.shardId {
+		sk.once.Do(func() {
+			close(sk.stalled)
+			<-sk.release
+		})
+	}
+	return sk.fakeKinesis.GetShardIterator(input)
+}
+
+func TestWorkerShutdownDoesNotWaitForKinesis(t *testing.T) {
+	fk := newFakeKinesis()
+	// the child is listed first so checking whether its parent was drained is the first call to Kinesis
+	fk.addShard("shard-1", "shard-0")
+	fk.addShard("shard-0")
+
+	sk := &stallingKinesis{
+		fakeKinesis: fk,
+		shardId:     "shard-0",
+		stalled:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	client := newTestClient(fk)
+	client.kinesis = sk
+
+	worker, err := client.NewWorkerWithParameters("stream", "client", func(shard *ShardInfo) RecordProcessor {
+		return &checkpointingProcessor{mu: &sync.Mutex{}}
+	}, time.Millisecond, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- worker.Run()
+	}()
+	<-sk.stalled
+
+	shutdown := make(chan struct{})
+	go func() {
+		worker.Shutdown()
+		close(shutdown)
+	}()
+
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Error("Shutdown waited for the stalled call to Kinesis")
+	}
+	close(sk.release)
+
+	<-shutdown
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+
+	worker.shardsMu.Lock()
+	defer worker.shardsMu.Unlock()
+	if len(worker.shards) > 0 {
+		t.Errorf("%d shards were started after the worker was shut down", len(worker.shards))
+	}
+}